@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// USERS caches the chat platform's users so attendee emails on Google events
+// can be turned into mentions without asking for every reminder.
+var USERS struct {
+	sync.Mutex
+	ByEmail map[string]ChatUser
+	ById    map[string]ChatUser
+	Fetched time.Time
+}
+
+const users_refresh = time.Hour
+
+// refresh_users must be called with USERS locked.
+func refresh_users(force bool) {
+	log := logger("USERS")
+	if !force && time.Since(USERS.Fetched) < users_refresh {
+		return
+	}
+	// Don't hammer the chat platform when someone's email just isn't there.
+	if force && time.Since(USERS.Fetched) < 10*time.Minute {
+		return
+	}
+
+	users, err := CHAT.Users()
+	if err != nil {
+		log.Error("Error fetching the users list", "error", err)
+		return
+	}
+	USERS.ByEmail = make(map[string]ChatUser)
+	USERS.ById = make(map[string]ChatUser)
+	for _, user := range users {
+		USERS.ById[user.Id] = user
+		if user.Email != "" {
+			USERS.ByEmail[strings.ToLower(user.Email)] = user
+		}
+	}
+	USERS.Fetched = time.Now()
+	log.Info("Cached the users list", "users", len(USERS.ById))
+}
+
+func user_by_email(email string) (ChatUser, bool) {
+	USERS.Lock()
+	defer USERS.Unlock()
+
+	refresh_users(false)
+	user, ok := USERS.ByEmail[strings.ToLower(email)]
+	if !ok {
+		refresh_users(true)
+		user, ok = USERS.ByEmail[strings.ToLower(email)]
+	}
+	return user, ok
+}
+
+func user_by_id(id string) (ChatUser, bool) {
+	USERS.Lock()
+	defer USERS.Unlock()
+
+	refresh_users(false)
+	user, ok := USERS.ById[id]
+	return user, ok
+}
+
+func user_location(user ChatUser) *time.Location {
+	if user.TZ != "" {
+		if loc, err := time.LoadLocation(user.TZ); err == nil {
+			return loc
+		}
+	}
+	return TIMEZONE
+}
+
+// event_attendees returns the chat users invited to a Google event, leaving
+// out anyone who declined.
+func event_attendees(event map[string]interface{}) []ChatUser {
+	var users []ChatUser
+	attendees, _ := event["attendees"].([]interface{})
+	for _, entry := range attendees {
+		attendee, ok := entry.(map[string]interface{})
+		if !ok || attendee["responseStatus"] == "declined" {
+			continue
+		}
+		if resource, _ := attendee["resource"].(bool); resource {
+			continue
+		}
+		email, _ := attendee["email"].(string)
+		if user, ok := user_by_email(email); ok {
+			users = append(users, user)
+		}
+	}
+	return users
+}
+
+func format_event_details(event map[string]interface{}, start time.Time, loc *time.Location) string {
+	details := "\nWhen: " + start.In(loc).Format("3:04pm MST")
+	if location, _ := event["location"].(string); location != "" {
+		details += "\nWhere: " + location
+	}
+	if link, _ := event["htmlLink"].(string); link != "" {
+		details += "\n<" + link + "|View in Google Calendar>"
+	}
+	return details
+}
+
+// format_channel_reminder is the reminder posted to the default channel. It
+// mentions every attendee we can find in the chat and, for anyone in a different
+// timezone, adds the start time where they are.
+func format_channel_reminder(event map[string]interface{}, start time.Time, before time.Duration) string {
+	summary := event["summary"].(string)
+	attendees := event_attendees(event)
+
+	greeting := "Hey Guys!"
+	if len(attendees) > 0 {
+		var mentions []string
+		for _, user := range attendees {
+			mentions = append(mentions, "<@"+user.Id+">")
+		}
+		greeting = "Hey " + strings.Join(mentions, " ") + "!"
+	}
+	text := fmt.Sprintf("%s Dont forget, %s is coming up in %s!", greeting, summary, format_offset(before))
+	text += format_event_details(event, start, TIMEZONE)
+
+	here := start.In(TIMEZONE).Format("3:04pm MST")
+	for _, user := range attendees {
+		if there := start.In(user_location(user)).Format("3:04pm MST"); there != here {
+			text += fmt.Sprintf("\n(%s for <@%s>)", there, user.Id)
+		}
+	}
+	return text
+}
+
+// format_dm_reminder is the reminder sent to a subscriber, with the time
+// shown in their own timezone.
+func format_dm_reminder(event map[string]interface{}, start time.Time, before time.Duration, user string) string {
+	loc := TIMEZONE
+	if u, ok := user_by_id(user); ok {
+		loc = user_location(u)
+	}
+	return fmt.Sprintf("Reminder: %s starts in %s.", event["summary"].(string), format_offset(before)) + format_event_details(event, start, loc)
+}
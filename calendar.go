@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CALENDAR_API is where Calendar API requests are sent.
+var CALENDAR_API = "https://www.googleapis.com/calendar/v3"
+
+const (
+	call_timeout     = 15 * time.Second
+	call_attempts    = 4
+	call_min_backoff = 500 * time.Millisecond
+	call_max_backoff = 30 * time.Second
+)
+
+// calendarError is a failed Calendar API request. Temporary errors are the
+// ones worth retrying: server errors, rate limiting and network trouble.
+type calendarError struct {
+	Status    int
+	Reason    string
+	Message   string
+	Temporary bool
+}
+
+func (e *calendarError) Error() string {
+	if e.Status == 0 {
+		return "calendar request failed: " + e.Message
+	}
+	return fmt.Sprintf("calendar request failed: %d %s: %s", e.Status, e.Reason, e.Message)
+}
+
+// user_error describes a failed call in a way that's fit to post in chat.
+func user_error(err error) string {
+	cerr, ok := err.(*calendarError)
+	switch {
+	case !ok:
+		return "Sorry, something went wrong talking to the calendar."
+	case cerr.Temporary:
+		return "Calendar is temporarily unavailable, try again in a few minutes."
+	case cerr.Status == http.StatusNotFound || cerr.Status == http.StatusForbidden:
+		return "I don't have access to that calendar."
+	}
+	return "Sorry, the calendar didn't like that request."
+}
+
+// api_error builds a calendarError from a non-2xx response, using the reason
+// Google puts in the body when there is one.
+func api_error(response *http.Response, body []byte) *calendarError {
+	var parsed struct {
+		Error struct {
+			Message string
+			Errors  []struct {
+				Reason string
+			}
+		}
+	}
+	cerr := &calendarError{Status: response.StatusCode, Reason: http.StatusText(response.StatusCode)}
+	if json.Unmarshal(body, &parsed) == nil {
+		cerr.Message = parsed.Error.Message
+		if len(parsed.Error.Errors) > 0 {
+			cerr.Reason = parsed.Error.Errors[0].Reason
+		}
+	}
+
+	switch {
+	case response.StatusCode >= 500, response.StatusCode == http.StatusTooManyRequests:
+		cerr.Temporary = true
+	case cerr.Reason == "rateLimitExceeded", cerr.Reason == "userRateLimitExceeded":
+		cerr.Temporary = true
+	}
+	return cerr
+}
+
+func retry_after(response *http.Response) time.Duration {
+	if response == nil {
+		return 0
+	}
+	seconds, err := strconv.Atoi(response.Header.Get("Retry-After"))
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// calendarRequest builds the URL for a Calendar API method. Path parameters
+// such as {calendarId} are path-escaped, and query parameters are encoded and
+// may repeat.
+type calendarRequest struct {
+	path   string
+	params map[string]string
+	query  url.Values
+}
+
+var path_param_rx = regexp.MustCompile("\\{(\\w+)\\}")
+
+func calendar_request(path string) *calendarRequest {
+	return &calendarRequest{path: path, params: make(map[string]string), query: make(url.Values)}
+}
+
+// Param fills in a {name} placeholder in the path.
+func (r *calendarRequest) Param(name, value string) *calendarRequest {
+	r.params[name] = value
+	return r
+}
+
+// Set replaces a query parameter.
+func (r *calendarRequest) Set(name, value string) *calendarRequest {
+	r.query.Set(name, value)
+	return r
+}
+
+// Add appends another value for a query parameter.
+func (r *calendarRequest) Add(name, value string) *calendarRequest {
+	r.query.Add(name, value)
+	return r
+}
+
+func (r *calendarRequest) URL(base string) (string, error) {
+	var missing []string
+	path := path_param_rx.ReplaceAllStringFunc(r.path, func(match string) string {
+		name := match[1 : len(match)-1]
+		value, ok := r.params[name]
+		if !ok {
+			missing = append(missing, name)
+			return match
+		}
+		return url.PathEscape(value)
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("missing path parameters for %s: %s", r.path, strings.Join(missing, ", "))
+	}
+
+	full := strings.TrimSuffix(base, "/") + path
+	if len(r.query) > 0 {
+		full += "?" + r.query.Encode()
+	}
+	return full, nil
+}
+
+func (r *calendarRequest) String() string {
+	full, err := r.URL("")
+	if err != nil {
+		return r.path
+	}
+	return full
+}
+
+// call makes a GET request to the Calendar API, giving each attempt its own
+// timeout and retrying temporary failures with backoff until ctx is done.
+func call(ctx context.Context, client *http.Client, request *calendarRequest) ([]byte, error) {
+	log := logger("CALL")
+	target, err := request.URL(CALENDAR_API)
+	if err != nil {
+		return nil, &calendarError{Message: err.Error()}
+	}
+
+	for attempt := 1; attempt <= call_attempts; attempt++ {
+		var body []byte
+		var response *http.Response
+
+		log.Debug("Calling method", "method", request, "attempt", attempt)
+		started := time.Now()
+		body, response, err = call_once(ctx, client, target)
+		record_calendar_call(err)
+		CALENDAR_LATENCY.Observe(time.Since(started).Seconds())
+		if response != nil {
+			CALENDAR_REQUESTS.Inc(strconv.Itoa(response.StatusCode))
+		} else {
+			CALENDAR_REQUESTS.Inc("error")
+		}
+		if err == nil {
+			return body, nil
+		}
+		if cerr, ok := err.(*calendarError); !ok || !cerr.Temporary || attempt == call_attempts {
+			break
+		}
+
+		wait := backoff(attempt, call_min_backoff, call_max_backoff)
+		if after := retry_after(response); after > wait {
+			wait = after
+		}
+		log.Warn("Calendar request failed, retrying", "method", request, "attempt", attempt, "retry_in", wait, "error", err)
+		if !sleep(ctx, wait) {
+			return nil, &calendarError{Message: ctx.Err().Error()}
+		}
+	}
+	return nil, err
+}
+
+func call_once(ctx context.Context, client *http.Client, url string) ([]byte, *http.Response, error) {
+	ctx, cancel := context.WithTimeout(ctx, call_timeout)
+	defer cancel()
+
+	request, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, nil, &calendarError{Message: err.Error()}
+	}
+	response, err := client.Do(request.WithContext(ctx))
+	if err != nil {
+		return nil, nil, &calendarError{Message: err.Error(), Temporary: true}
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, response, &calendarError{Status: response.StatusCode, Message: err.Error(), Temporary: true}
+	}
+	logger("CALL").Debug("Got response", "status", response.StatusCode, "length", len(body))
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return nil, response, api_error(response, body)
+	}
+	return body, response, nil
+}
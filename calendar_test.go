@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fake_calendar points CALENDAR_API at a test server for the rest of the
+// test, recording every request it gets.
+func fake_calendar(t *testing.T, handler http.HandlerFunc) *[]*http.Request {
+	var lock sync.Mutex
+	var seen []*http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		seen = append(seen, r)
+		lock.Unlock()
+		handler(w, r)
+	}))
+	api := CALENDAR_API
+	CALENDAR_API = server.URL
+	t.Cleanup(func() {
+		CALENDAR_API = api
+		server.Close()
+	})
+	return &seen
+}
+
+func ok_handler(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte(`{"items":[]}`))
+}
+
+func TestCallEscapesPathAndQuery(t *testing.T) {
+	seen := fake_calendar(t, ok_handler)
+
+	request := calendar_request("/calendars/{calendarId}/events").
+		Param("calendarId", "team#dev@group.calendar.google.com").
+		Set("timeMin", "2024-03-01T09:00:00+05:00").
+		Add("eventTypes", "default").
+		Add("eventTypes", "focusTime")
+	if _, err := call(context.Background(), http.DefaultClient, request); err != nil {
+		t.Fatal(err)
+	}
+	if len(*seen) != 1 {
+		t.Fatalf("got %d requests, want 1", len(*seen))
+	}
+	got := (*seen)[0]
+
+	if path := got.URL.EscapedPath(); path != "/calendars/team%23dev@group.calendar.google.com/events" {
+		t.Errorf("path = %q", path)
+	}
+	if got.URL.Path != "/calendars/team#dev@group.calendar.google.com/events" {
+		t.Errorf("unescaped path = %q", got.URL.Path)
+	}
+	query := got.URL.Query()
+	if min := query.Get("timeMin"); min != "2024-03-01T09:00:00+05:00" {
+		t.Errorf("timeMin = %q", min)
+	}
+	if types := query["eventTypes"]; len(types) != 2 || types[0] != "default" || types[1] != "focusTime" {
+		t.Errorf("eventTypes = %q", types)
+	}
+}
+
+func TestCallMissingParam(t *testing.T) {
+	seen := fake_calendar(t, ok_handler)
+
+	_, err := call(context.Background(), http.DefaultClient, calendar_request("/calendars/{calendarId}/events"))
+	if err == nil {
+		t.Fatal("want an error for the missing {calendarId}")
+	}
+	if cerr, ok := err.(*calendarError); !ok || cerr.Temporary {
+		t.Errorf("err = %#v, want a permanent calendarError", err)
+	}
+	if len(*seen) != 0 {
+		t.Errorf("got %d requests, want none", len(*seen))
+	}
+}
+
+// failure is one canned error response.
+type failure struct {
+	status      int
+	body        string
+	retry_after string
+}
+
+// failing answers the first len(failures) requests with them, then succeeds.
+func failing(failures ...failure) http.HandlerFunc {
+	var lock sync.Mutex
+	return func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		if len(failures) == 0 {
+			ok_handler(w, r)
+			return
+		}
+		f := failures[0]
+		failures = failures[1:]
+		if f.retry_after != "" {
+			w.Header().Set("Retry-After", f.retry_after)
+		}
+		w.WriteHeader(f.status)
+		w.Write([]byte(f.body))
+	}
+}
+
+func TestCallRetries(t *testing.T) {
+	rate_limited := `{"error":{"message":"Rate Limit Exceeded","errors":[{"reason":"rateLimitExceeded"}]}}`
+	forbidden := `{"error":{"message":"Forbidden","errors":[{"reason":"forbidden"}]}}`
+
+	tests := []struct {
+		name     string
+		failures []failure
+		requests int
+		ok       bool
+	}{
+		{"server error", []failure{{status: 503}}, 2, true},
+		{"too many requests", []failure{{status: 429}}, 2, true},
+		{"rate limit reason", []failure{{status: 403, body: rate_limited}}, 2, true},
+		{"forbidden", []failure{{status: 403, body: forbidden}}, 1, false},
+		{"not found", []failure{{status: 404}}, 1, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			seen := fake_calendar(t, failing(test.failures...))
+			_, err := call(context.Background(), http.DefaultClient, calendar_request("/users/me/calendarList"))
+			if (err == nil) != test.ok {
+				t.Errorf("err = %v", err)
+			}
+			if len(*seen) != test.requests {
+				t.Errorf("got %d requests, want %d", len(*seen), test.requests)
+			}
+		})
+	}
+}
+
+func TestCallRetryAfter(t *testing.T) {
+	seen := fake_calendar(t, failing(failure{status: 429, retry_after: "2"}))
+
+	started := time.Now()
+	if _, err := call(context.Background(), http.DefaultClient, calendar_request("/users/me/calendarList")); err != nil {
+		t.Fatal(err)
+	}
+	if waited := time.Since(started); waited < 2*time.Second {
+		t.Errorf("retried after %s, want at least the 2s Retry-After", waited)
+	}
+	if len(*seen) != 2 {
+		t.Errorf("got %d requests, want 2", len(*seen))
+	}
+}
+
+func TestCallGivesUp(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits out every backoff")
+	}
+	var failures []failure
+	for i := 0; i < call_attempts; i++ {
+		failures = append(failures, failure{status: 500})
+	}
+	seen := fake_calendar(t, failing(failures...))
+
+	_, err := call(context.Background(), http.DefaultClient, calendar_request("/users/me/calendarList"))
+	if cerr, ok := err.(*calendarError); !ok || !cerr.Temporary || cerr.Status != 500 {
+		t.Errorf("err = %#v, want a temporary 500", err)
+	}
+	if len(*seen) != call_attempts {
+		t.Errorf("got %d requests, want %d", len(*seen), call_attempts)
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// eventState is the part of a calendar event we care about when looking for
+// changes between two polls of the same calendar.
+type eventState struct {
+	Summary string
+	Status  string
+	Start   time.Time
+	End     time.Time
+	AllDay  bool
+	Created time.Time
+	Updated time.Time
+}
+
+func get_event_state(event map[string]interface{}) eventState {
+	var state eventState
+	if summary, ok := event["summary"].(string); ok {
+		state.Summary = summary
+	}
+	if status, ok := event["status"].(string); ok {
+		state.Status = status
+	}
+	if start, ok := event["start"].(map[string]interface{}); ok {
+		_, state.AllDay = start["date"]
+		state.Start, _ = get_date_from_google_shit(start)
+	}
+	if end, ok := event["end"].(map[string]interface{}); ok {
+		state.End, _ = get_date_from_google_shit(end)
+	}
+	if created, ok := event["created"].(string); ok {
+		state.Created, _ = time.Parse(time.RFC3339, created)
+	}
+	if updated, ok := event["updated"].(string); ok {
+		state.Updated, _ = time.Parse(time.RFC3339, updated)
+	}
+	return state
+}
+
+func format_change_time(t time.Time, all_day bool) string {
+	if all_day {
+		return t.Format("Mon Jan 2")
+	}
+	t = t.In(TIMEZONE)
+	layout := "Mon 3:04pm"
+	if t.Minute() == 0 {
+		layout = "Mon 3pm"
+	}
+	if t.Sub(time.Now()) > 6*24*time.Hour {
+		layout = "Jan 2 " + layout
+	}
+	return t.Format(layout)
+}
+
+// added_slack allows for the calendar's clock being a little ahead of ours
+// when deciding whether an event was created or updated since the last poll.
+const added_slack = time.Minute
+
+// diff_snapshots compares two polls of a calendar, the older one taken at
+// since, and describes every event that was added, moved, renamed or
+// cancelled in between, soonest first. The polled window moves forward with
+// time, so an event we haven't seen before is only news if it was updated
+// since the last poll: it is new if it was created then too, and otherwise
+// it was moved into the window. Events moved out of the window have to be
+// looked up and passed in current (see moved_out) to be reported.
+func diff_snapshots(old, current map[string]eventState, since time.Time) []string {
+	type change struct {
+		start time.Time
+		text  string
+	}
+	var changes []change
+	add := func(start time.Time, format string, args ...interface{}) {
+		changes = append(changes, change{start, fmt.Sprintf(format, args...)})
+	}
+
+	for id, now := range current {
+		before, seen := old[id]
+		if !seen {
+			if now.Status == "cancelled" || now.Summary == "" || !now.Updated.After(since.Add(-added_slack)) {
+				continue
+			}
+			if now.Created.After(since.Add(-added_slack)) {
+				add(now.Start, "📅 Added: %s on %s", now.Summary, format_change_time(now.Start, now.AllDay))
+			} else {
+				add(now.Start, "📅 Changed: %s moved to %s", now.Summary, format_change_time(now.Start, now.AllDay))
+			}
+			continue
+		}
+		if before.Status == "cancelled" {
+			continue
+		}
+		if now.Status == "cancelled" {
+			add(before.Start, "📅 Cancelled: %s (%s)", before.Summary, format_change_time(before.Start, before.AllDay))
+			continue
+		}
+
+		var what []string
+		if now.Summary != before.Summary {
+			what = append(what, fmt.Sprintf("renamed to %s", now.Summary))
+		}
+		if !now.Start.Equal(before.Start) || now.AllDay != before.AllDay {
+			what = append(what, fmt.Sprintf("moved from %s to %s", format_change_time(before.Start, before.AllDay), format_change_time(now.Start, now.AllDay)))
+		}
+		if len(what) > 0 {
+			add(now.Start, "📅 Changed: %s %s", before.Summary, strings.Join(what, " and "))
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		if !changes[i].start.Equal(changes[j].start) {
+			return changes[i].start.Before(changes[j].start)
+		}
+		return changes[i].text < changes[j].text
+	})
+	lines := make([]string, len(changes))
+	for i, c := range changes {
+		lines[i] = c.text
+	}
+	return lines
+}
+
+// resolve_calendar turns a name from Calendar_Name (or "default") into its
+// calendar id. Anything else is assumed to already be a calendar id.
+func resolve_calendar(name string) string {
+	if strings.ToLower(name) == "default" {
+		return profile().Default_Calendar
+	}
+	for i, cal_name := range profile().Calendar_Name {
+		if strings.ToLower(cal_name) == strings.ToLower(name) && i < len(profile().Calendar) {
+			return profile().Calendar[i]
+		}
+	}
+	return name
+}
+
+func poll_calendar(ctx context.Context, gApi *http.Client, calendarId string) (map[string]eventState, error) {
+	now := time.Now().In(TIMEZONE)
+	window := profile().Announce_Window
+	if window <= 0 {
+		window = 14
+	}
+
+	request := calendar_request("/calendars/{calendarId}/events").
+		Param("calendarId", calendarId).
+		Set("timeMin", now.Format(time.RFC3339)).
+		Set("timeMax", now.AddDate(0, 0, window).Format(time.RFC3339)).
+		Set("singleEvents", "true").
+		Set("showDeleted", "true").
+		Set("maxResults", "2500")
+
+	snapshot := make(map[string]eventState)
+	for {
+		resp, err := call(ctx, gApi, request)
+		if err != nil {
+			return nil, err
+		}
+
+		var response map[string]interface{}
+		if err := json.Unmarshal(resp, &response); err != nil {
+			return nil, err
+		}
+		items, ok := response["items"].([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("no events in response: %s", resp)
+		}
+		for _, item := range items {
+			event, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if id, ok := event["id"].(string); ok {
+				snapshot[id] = get_event_state(event)
+			}
+		}
+
+		token, _ := response["nextPageToken"].(string)
+		if token == "" {
+			return snapshot, nil
+		}
+		request.Set("pageToken", token)
+	}
+}
+
+// moved_out returns current plus every event from old that is missing from
+// it although it hasn't finished yet. Those were moved out of the window (or
+// deleted), so each is looked up again for diff_snapshots to say where it
+// went. Events that have finished just dropped out of the window.
+func moved_out(ctx context.Context, gApi *http.Client, calendarId string, old, current map[string]eventState, now time.Time, log *Logger) map[string]eventState {
+	merged := make(map[string]eventState, len(current))
+	for id, state := range current {
+		merged[id] = state
+	}
+	for id, before := range old {
+		if _, ok := current[id]; ok || before.Status == "cancelled" || !before.End.After(now) {
+			continue
+		}
+		request := calendar_request("/calendars/{calendarId}/events/{eventId}").
+			Param("calendarId", calendarId).
+			Param("eventId", id)
+		resp, err := call(ctx, gApi, request)
+		if err != nil {
+			log.Error("Error looking up event", "event", id, "error", err)
+			continue
+		}
+		var event map[string]interface{}
+		if err := json.Unmarshal(resp, &event); err != nil {
+			log.Error("Error looking up event", "event", id, "error", err)
+			continue
+		}
+		merged[id] = get_event_state(event)
+	}
+	return merged
+}
+
+// CHANGE_WATCHERS lets a reload restart the watchers when the calendars to
+// announce, or how they are polled, have changed.
+var CHANGE_WATCHERS struct {
+	sync.Mutex
+	cancel   context.CancelFunc
+	settings string
+}
+
+// start_change_watchers starts a watch_calendar_changes for every calendar in
+// Announce_Changes, replacing any started before with different settings.
+func start_change_watchers(ctx context.Context, gApi *http.Client, chSender chan InternalMessage) {
+	var calendars []string
+	for _, name := range profile().Announce_Changes {
+		calendars = append(calendars, resolve_calendar(name))
+	}
+	settings := fmt.Sprint(calendars, profile().Announce_Interval, profile().Announce_Window)
+
+	CHANGE_WATCHERS.Lock()
+	defer CHANGE_WATCHERS.Unlock()
+	if CHANGE_WATCHERS.cancel != nil {
+		if CHANGE_WATCHERS.settings == settings {
+			return
+		}
+		CHANGE_WATCHERS.cancel()
+	}
+
+	watchCtx, cancel := context.WithCancel(ctx)
+	CHANGE_WATCHERS.cancel = cancel
+	CHANGE_WATCHERS.settings = settings
+	for _, calendarId := range calendars {
+		go watch_calendar_changes(watchCtx, gApi, calendarId, chSender)
+	}
+}
+
+func watch_calendar_changes(ctx context.Context, gApi *http.Client, calendarId string, chSender chan InternalMessage) {
+	log := logger("CHANGES").With("calendar", calendarId)
+	var snapshot map[string]eventState
+	var polled time.Time
+	interval := time.Duration(profile().Announce_Interval) * time.Minute
+	if interval <= 0 {
+		interval = 5 * time.Minute
+	}
+
+	for {
+		started := time.Now()
+		current, err := poll_calendar(ctx, gApi, calendarId)
+		if err != nil {
+			log.Error("Error polling calendar", "error", err)
+		} else {
+			if snapshot != nil {
+				changes := diff_snapshots(snapshot, moved_out(ctx, gApi, calendarId, snapshot, current, started, log), polled)
+				if len(changes) > 0 {
+					log.Info("Found changes", "changes", len(changes))
+					msg := allocInternalMessage()
+					msg.Outgoing.Text = strings.Join(changes, "\n")
+					notify(NOTIFY_CHANGES, msg, chSender)
+				}
+			}
+			snapshot = current
+			polled = started
+		}
+		if !sleep(ctx, interval) {
+			return
+		}
+	}
+}
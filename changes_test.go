@@ -0,0 +1,65 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDiffSnapshots(t *testing.T) {
+	TIMEZONE = time.UTC
+	since := time.Now().Truncate(time.Minute)
+	before := since.Add(-time.Hour)
+	after := since.Add(2 * time.Minute)
+	nine := since.Add(24 * time.Hour)
+	ten := nine.Add(time.Hour)
+
+	standup := eventState{Summary: "Standup", Status: "confirmed", Start: nine, End: nine.Add(15 * time.Minute), Created: before, Updated: before}
+	moved := standup
+	moved.Start, moved.End, moved.Updated = ten, ten.Add(15*time.Minute), after
+	renamed := standup
+	renamed.Summary, renamed.Updated = "Daily sync", after
+	cancelled := standup
+	cancelled.Status, cancelled.Updated = "cancelled", after
+	added := standup
+	added.Created, added.Updated = after, after
+	moved_in := moved
+	quietly_in := standup
+	quietly_in.Start = ten
+
+	tests := []struct {
+		name     string
+		old, now map[string]eventState
+		want     []string
+	}{
+		{"unchanged", map[string]eventState{"a": standup}, map[string]eventState{"a": standup}, nil},
+		{"added", nil, map[string]eventState{"a": added},
+			[]string{"📅 Added: Standup on " + format_change_time(nine, false)}},
+		{"moved", map[string]eventState{"a": standup}, map[string]eventState{"a": moved},
+			[]string{"📅 Changed: Standup moved from " + format_change_time(nine, false) + " to " + format_change_time(ten, false)}},
+		{"moved into the window", nil, map[string]eventState{"a": moved_in},
+			[]string{"📅 Changed: Standup moved to " + format_change_time(ten, false)}},
+		{"came into the window", nil, map[string]eventState{"a": quietly_in}, nil},
+		{"renamed", map[string]eventState{"a": standup}, map[string]eventState{"a": renamed},
+			[]string{"📅 Changed: Standup renamed to Daily sync"}},
+		{"cancelled", map[string]eventState{"a": standup}, map[string]eventState{"a": cancelled},
+			[]string{"📅 Cancelled: Standup (" + format_change_time(nine, false) + ")"}},
+		{"already cancelled", map[string]eventState{"a": cancelled}, map[string]eventState{"a": cancelled}, nil},
+		{"dropped out", map[string]eventState{"a": standup}, nil, nil},
+		{"soonest first", nil, map[string]eventState{"a": moved_in, "b": added}, []string{
+			"📅 Added: Standup on " + format_change_time(nine, false),
+			"📅 Changed: Standup moved to " + format_change_time(ten, false),
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := diff_snapshots(test.old, test.now, since)
+			if len(got) == 0 && len(test.want) == 0 {
+				return
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Message is a chat message, received or to be sent, in a form every chat
+// platform can fill in. Text uses Slack's markup (<@user>, <#channel>); other
+// adapters translate it. ReplyTo is the platform's own way of answering a
+// received message, such as a slash command's response_url; replies carry
+// it back to the adapter. ThreadId is the thread a message was posted in or
+// is to be posted to, and Direct marks a direct message with the bot.
+// Blocks, when there are any, are a richer layout of the same content for
+// adapters that can show one; Text must still say everything.
+type Message struct {
+	Id        string
+	UserId    string
+	ChannelId string
+	Text      string
+	ReplyTo   string
+	ThreadId  string
+	Direct    bool
+	Blocks    []Block
+}
+
+// Block is one section of a rich message: a heading and its lines, in the
+// same markup as Message.Text.
+type Block struct {
+	Heading string
+	Lines   []string
+}
+
+// ChatUser is someone on the chat platform.
+type ChatUser struct {
+	Id    string
+	Name  string
+	Email string
+	TZ    string
+}
+
+// ChatAdapter is everything the bot needs from a chat platform. Command logic
+// only ever talks to the platform through CHAT.
+type ChatAdapter interface {
+	// Run stays connected until ctx is done, passing every message the bot
+	// can see to incoming and calling chat_connected each time it connects.
+	Run(ctx context.Context, incoming chan Message)
+	Connected() bool
+
+	// Send posts msg and returns the platform's id for it, for Edit and
+	// React.
+	Send(msg Message) (string, error)
+	Edit(channel, id, text string) error
+	React(channel, id, emoji string) error
+
+	// DM returns the channel for direct messages with user.
+	DM(user string) (string, error)
+	User(id string) (ChatUser, error)
+	Users() ([]ChatUser, error)
+	// Channel finds a channel's id from its name.
+	Channel(name string) (string, error)
+}
+
+var CHAT ChatAdapter
+
+// new_chat_adapter connects to the platform named by the profile's Chat
+// setting, Slack by default.
+func new_chat_adapter(p *Profile) ChatAdapter {
+	switch strings.ToLower(p.Chat) {
+	case "discord":
+		return new_discord_adapter(p.Discord, p.Discord_Guild, p.Discord_API)
+	case "matrix":
+		return new_matrix_adapter(p.Matrix_Homeserver, p.Matrix)
+	case "irc":
+		return new_irc_adapter(p.IRC_Server, p.IRC_Nick, p.IRC_Password, p.IRC_Channel, p.IRC_TLS)
+	default:
+		return new_slack_adapter(p.Slack, p.Slack_Listen, p.Slack_Signing_Secret)
+	}
+}
+
+var slack_link_rx = regexp.MustCompile(`<(https?://[^|>]+)\|([^>]+)>`)
+var slack_bold_rx = regexp.MustCompile(`(^|\s)\*([^*\n]+)\*`)
+var slack_mention_rx = regexp.MustCompile(`<[@#]([^|>]+)(?:\|([^>]*))?>`)
+
+var slack_escaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// slack_escape keeps text from being read as markup, e.g. an event title
+// with a < in it.
+func slack_escape(text string) string {
+	return slack_escaper.Replace(text)
+}
+
+// plain_text strips the Slack markup from text for platforms that have none:
+// links become "text (url)", mentions the bare id or name, and bold is
+// dropped.
+func plain_text(text string) string {
+	text = slack_link_rx.ReplaceAllString(text, "$2 ($1)")
+	text = slack_mention_rx.ReplaceAllStringFunc(text, func(mention string) string {
+		m := slack_mention_rx.FindStringSubmatch(mention)
+		if m[2] != "" {
+			return m[2]
+		}
+		return m[1]
+	})
+	return slack_bold_rx.ReplaceAllString(text, "$1$2")
+}
+
+var ErrNotConnected = errors.New("not connected")
+var ErrNotSupported = &chatError{Message: "not supported on this chat platform"}
+
+// chatError is a failure the chat platform reported. Unless it is Temporary,
+// trying again won't help. Other errors, such as network failures, are
+// assumed to be temporary. Code is the platform's own error code, if it sent
+// one.
+type chatError struct {
+	Message   string
+	Temporary bool
+	Code      int
+}
+
+func (e *chatError) Error() string {
+	return e.Message
+}
+
+func temporary(err error) bool {
+	if e, ok := err.(*chatError); ok {
+		return e.Temporary
+	}
+	return true
+}
+
+// CHAT_UP tells sender the adapter has connected, so anything that queued up
+// while it was away can be replayed.
+var CHAT_UP = make(chan bool, 1)
+
+// chat_connected is called by adapters every time they (re)connect.
+func chat_connected() {
+	STATUS.Lock()
+	STATUS.connected = time.Now()
+	STATUS.Unlock()
+
+	select {
+	case CHAT_UP <- true:
+	default:
+	}
+}
+
+// chat_status reports whether the adapter is connected, and since when.
+func chat_status() (bool, time.Time) {
+	if CHAT == nil || !CHAT.Connected() {
+		return false, time.Time{}
+	}
+	STATUS.Lock()
+	defer STATUS.Unlock()
+	return true, STATUS.connected
+}
+
+const (
+	max_outbox   = 100
+	outbox_retry = 30 * time.Second
+)
+
+// sender posts everything queued on outbox through CHAT. Messages that can't
+// be sent wait in a bounded queue and are retried in order when the adapter
+// reconnects, or every outbox_retry. When ctx is cancelled it makes one last
+// attempt to send whatever is left so replies like ^restart's still go out.
+func sender(ctx context.Context, outbox chan InternalMessage, done chan bool) {
+	log := logger("OUTBOX")
+	defer close(done)
+	var pending []InternalMessage
+
+	flush := func() {
+		for len(pending) > 0 {
+			msg := pending[0]
+			log.Debug("Sending message", "channel", msg.Outgoing.ChannelId, "text", msg.Outgoing.Text)
+			if _, err := CHAT.Send(*msg.Outgoing); err != nil && !temporary(err) {
+				log.Error("Dropping message that can't be sent", "channel", msg.Outgoing.ChannelId, "error", err)
+				CHAT_MESSAGES.Inc("failed")
+				pending = pending[1:]
+				continue
+			} else if err != nil {
+				log.Warn("Error sending message, will retry", "error", err)
+				CHAT_MESSAGES.Inc("failed")
+				return
+			}
+			pending = pending[1:]
+			CHAT_MESSAGES.Inc("sent")
+		}
+	}
+	queue := func(msg InternalMessage) {
+		if len(pending) >= max_outbox {
+			log.Warn("Queue full, dropping oldest message", "text", pending[0].Outgoing.Text)
+			CHAT_MESSAGES.Inc("dropped")
+			pending = pending[1:]
+		}
+		pending = append(pending, msg)
+	}
+
+	retry := time.NewTicker(outbox_retry)
+	defer retry.Stop()
+
+	for {
+		select {
+		case msg := <-outbox:
+			queue(msg)
+			flush()
+		case <-CHAT_UP:
+			if len(pending) > 0 {
+				log.Info("Replaying queued messages", "count", len(pending))
+			}
+			flush()
+		case <-retry.C:
+			flush()
+		case <-ctx.Done():
+			for {
+				select {
+				case msg := <-outbox:
+					queue(msg)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
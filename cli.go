@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const usage_text = `Usage: %[1]s [flags] <command> [arguments]
+
+Commands:
+  run <profile>            connect to chat and run the bot (the default, so
+                           "%[1]s <profile>" works too)
+  check-config [profile]   report problems with the config and key files
+  list-profiles            list the profiles in the config file
+  query <profile> <range>  print the events in a range such as "next week"
+  send-digest <profile>    post today's morning message once and exit
+  console <profile>        type commands as a chat user and see the replies,
+                           without connecting to chat
+  version                  print the version and exit
+
+Flags may come before or after the command.
+
+Flags:
+`
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), usage_text, os.Args[0])
+	flag.PrintDefaults()
+}
+
+// parse_args parses flags wherever they appear among args and returns the
+// remaining arguments in order.
+func parse_args(args []string) []string {
+	var positional []string
+	for {
+		flag.CommandLine.Parse(args)
+		args = flag.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+func main() {
+	flag.Usage = usage
+	args := parse_args(os.Args[1:])
+
+	command := "run"
+	if len(args) > 0 {
+		switch args[0] {
+		case "run", "check-config", "list-profiles", "query", "send-digest", "console", "version", "help":
+			command, args = args[0], args[1:]
+		}
+	}
+	if CHECKCONFIG {
+		command = "check-config"
+	}
+
+	switch command {
+	case "run":
+		if len(args) != 1 {
+			usage()
+			os.Exit(2)
+		}
+		TEAM = args[0]
+		run_bot()
+	case "check-config":
+		if len(args) > 1 {
+			usage()
+			os.Exit(2)
+		}
+		if len(args) == 1 {
+			TEAM = args[0]
+		}
+		os.Exit(check_config(PROBE))
+	case "list-profiles":
+		os.Exit(list_profiles())
+	case "query":
+		if len(args) < 2 {
+			usage()
+			os.Exit(2)
+		}
+		TEAM = args[0]
+		os.Exit(query(strings.Join(args[1:], " ")))
+	case "send-digest":
+		if len(args) != 1 {
+			usage()
+			os.Exit(2)
+		}
+		TEAM = args[0]
+		os.Exit(send_digest())
+	case "console":
+		if len(args) != 1 {
+			usage()
+			os.Exit(2)
+		}
+		TEAM = args[0]
+		os.Exit(console())
+	case "version":
+		fmt.Printf("%s (%s)\n", VERSION, COMMIT)
+	case "help":
+		usage()
+	}
+}
+
+// setup_oneshot loads what a command that runs once needs: a checked config,
+// the timezone and a Calendar client. Logs go to stderr so they don't mix
+// with the command's output.
+func setup_oneshot() (*http.Client, error) {
+	if err := setup_config(); err != nil {
+		return nil, err
+	}
+	return setupAPIClient(KEY, "https://www.googleapis.com/auth/calendar")
+}
+
+func setup_config() error {
+	configure_logging(os.Stderr, "", "", nil)
+
+	config, err := load_config(CFGFILE)
+	if err != nil {
+		return err
+	}
+	if problems := validate_config(&config, CFGFILE, TEAM, false); len(problems) > 0 {
+		var lines []string
+		for _, p := range problems {
+			lines = append(lines, p.String())
+		}
+		return errors.New(strings.Join(lines, "\n"))
+	}
+	set_config(config)
+	if err := configure_logging(nil, config.Log.Format, config.Log.Level, config.Log.Component_Level); err != nil {
+		return err
+	}
+	redact_secrets(config_secrets(config))
+
+	TIMEZONE, err = time.LoadLocation(timezone_name)
+	return err
+}
+
+func list_profiles() int {
+	config, err := load_config(CFGFILE)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, CFGFILE+": "+err.Error())
+		return 1
+	}
+
+	var names []string
+	for name := range config.Profile {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("%s\tchannel %s\tcalendar %s\n", name, config.Profile[name].Default_Channel, config.Profile[name].Default_Calendar)
+	}
+	return 0
+}
+
+// query prints what ^events would reply with, failing if the range isn't a
+// date or the calendar can't be read.
+func query(args string) int {
+	gApi, err := setup_oneshot()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, redact(err.Error()))
+		return 1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	text, _, err := events_reply(ctx, gApi, strings.ToLower(args), "")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, redact(err.Error()))
+		return 1
+	}
+	fmt.Println(text)
+	return 0
+}
+
+// oneshot_connect is how long a command that sends once waits for a chat
+// that can only send over a live connection to connect.
+const oneshot_connect = 30 * time.Second
+
+// connect_oneshot connects CHAT for a command that sends once, if it can only
+// send while connected as IRC can, and returns a function that disconnects
+// it again. The others send without Run.
+func connect_oneshot() (func(), error) {
+	if _, live := CHAT.(*ircAdapter); !live {
+		return func() {}, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan bool)
+	go func() {
+		CHAT.Run(ctx, make(chan Message))
+		close(done)
+	}()
+	disconnect := func() {
+		cancel()
+		<-done
+	}
+
+	deadline := time.Now().Add(oneshot_connect)
+	for !CHAT.Connected() {
+		if time.Now().After(deadline) {
+			disconnect()
+			return nil, fmt.Errorf("not connected after %s", oneshot_connect)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return disconnect, nil
+}
+
+// send_digest posts today's morning message to the default channel. Nothing
+// is posted if the calendar can't be read.
+func send_digest() int {
+	gApi, err := setup_oneshot()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, redact(err.Error()))
+		return 1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	text, err := morning_message(ctx, gApi, time.Now().In(TIMEZONE), 1)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, redact("Error reading the calendar: "+err.Error()))
+		return 1
+	}
+
+	CHAT = new_chat_adapter(profile())
+	disconnect, err := connect_oneshot()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, redact("Error connecting to chat: "+err.Error()))
+		return 1
+	}
+	_, err = CHAT.Send(Message{ChannelId: profile().Default_Channel, Text: text})
+	disconnect()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, redact("Error posting the digest: "+err.Error()))
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CONFIG_LOCK guards swapping CONFIG for a reloaded one. A Profile is never
+// changed once loaded, so holding on to one from profile() is safe.
+var CONFIG_LOCK sync.RWMutex
+
+// profile returns the active profile from the current config.
+func profile() *Profile {
+	CONFIG_LOCK.RLock()
+	defer CONFIG_LOCK.RUnlock()
+	return CONFIG.Profile[TEAM]
+}
+
+func set_config(config ConfigFile) {
+	CONFIG_LOCK.Lock()
+	CONFIG = config
+	CONFIG_LOCK.Unlock()
+}
+
+// configProblem is something wrong with the config file, with the line it
+// was found on when we can tell.
+type configProblem struct {
+	Line    int
+	Message string
+}
+
+func (p configProblem) String() string {
+	if p.Line > 0 {
+		return fmt.Sprintf("%s:%d: %s", CFGFILE, p.Line, p.Message)
+	}
+	return fmt.Sprintf("%s: %s", CFGFILE, p.Message)
+}
+
+var config_section_rx = regexp.MustCompile(`^\s*\[\s*(\w+)(?:\s+"([^"]*)")?\s*\]`)
+var config_variable_rx = regexp.MustCompile(`^\s*([\w-]+)\s*(?:=|$)`)
+
+// configLines remembers where each section and variable first appears in the
+// config file, so problems found after gcfg has parsed it can point at a line.
+type configLines map[string]int
+
+func config_key(section, subsection, variable string) string {
+	key := strings.ToLower(section) + " " + subsection
+	if variable != "" {
+		key += "." + strings.ToLower(strings.Replace(variable, "-", "_", -1))
+	}
+	return key
+}
+
+func read_config_lines(file string) configLines {
+	lines := make(configLines)
+	f, err := os.Open(file)
+	if err != nil {
+		return lines
+	}
+	defer f.Close()
+
+	var section, subsection string
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		text := scanner.Text()
+		if m := config_section_rx.FindStringSubmatch(text); m != nil {
+			section, subsection = m[1], m[2]
+			if _, seen := lines[config_key(section, subsection, "")]; !seen {
+				lines[config_key(section, subsection, "")] = n
+			}
+		} else if m := config_variable_rx.FindStringSubmatch(text); m != nil {
+			if _, seen := lines[config_key(section, subsection, m[1])]; !seen {
+				lines[config_key(section, subsection, m[1])] = n
+			}
+		}
+	}
+	return lines
+}
+
+// line finds a variable in a section, falling back to the section header.
+func (lines configLines) line(section, subsection, variable string) int {
+	if n, ok := lines[config_key(section, subsection, variable)]; ok {
+		return n
+	}
+	return lines[config_key(section, subsection, "")]
+}
+
+var quiet_actions = []string{"", "send", "drop", "defer", "digest"}
+
+// validate_config checks everything gcfg can't: required settings, lists that
+// must line up, and values that are only parsed later on. It reports every
+// problem rather than stopping at the first. Only team's profile is checked
+// unless all is set, so a half-finished profile for another team doesn't
+// stop this one from running.
+func validate_config(config *ConfigFile, file, team string, all bool) []configProblem {
+	lines := read_config_lines(file)
+	var problems []configProblem
+	problem := func(line int, format string, args ...interface{}) {
+		problems = append(problems, configProblem{Line: line, Message: fmt.Sprintf(format, args...)})
+	}
+
+	var names []string
+	for name := range config.Profile {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if len(names) == 0 {
+		problem(0, "no [profile \"name\"] sections")
+	} else if _, ok := config.Profile[team]; !ok && team != "" {
+		problem(0, "unknown profile %q (have: %s)", team, strings.Join(names, ", "))
+	}
+
+	checked := names
+	if !all {
+		checked = nil
+		if _, ok := config.Profile[team]; ok {
+			checked = []string{team}
+		}
+	}
+	for _, name := range checked {
+		profile := config.Profile[name]
+		at := func(variable string) int {
+			return lines.line("profile", name, variable)
+		}
+
+		switch strings.ToLower(profile.Chat) {
+		case "", "slack":
+			if profile.Slack == "" && profile.Slack_File == "" {
+				problem(at("Slack"), "profile %q: Slack token is missing (set Slack, Slack-File or %s)", name, env_name(name, "Slack"))
+			}
+			if profile.Slack_Listen != "" && profile.Slack_Signing_Secret == "" {
+				problem(at("Slack-Listen"), "profile %q: Slack-Listen needs Slack-Signing-Secret (or Slack-Signing-Secret-File) to verify requests", name)
+			}
+		case "discord":
+			if profile.Discord == "" && profile.Discord_File == "" {
+				problem(at("Discord"), "profile %q: Discord token is missing (set Discord, Discord-File or %s)", name, env_name(name, "Discord"))
+			}
+		case "matrix":
+			if profile.Matrix == "" && profile.Matrix_File == "" {
+				problem(at("Matrix"), "profile %q: Matrix access token is missing (set Matrix, Matrix-File or %s)", name, env_name(name, "Matrix"))
+			}
+			if profile.Matrix_Homeserver == "" {
+				problem(at("Matrix-Homeserver"), "profile %q: Matrix-Homeserver is missing", name)
+			}
+		case "irc":
+			if profile.IRC_Server == "" {
+				problem(at("IRC-Server"), "profile %q: IRC-Server is missing", name)
+			} else if _, _, err := net.SplitHostPort(profile.IRC_Server); err != nil {
+				problem(at("IRC-Server"), "profile %q: IRC-Server %q should look like irc.example.org:6697", name, profile.IRC_Server)
+			}
+			if profile.IRC_Nick == "" {
+				problem(at("IRC-Nick"), "profile %q: IRC-Nick is missing", name)
+			}
+			for _, channel := range profile.IRC_Channel {
+				if !strings.HasPrefix(channel, "#") && !strings.HasPrefix(channel, "&") {
+					problem(at("IRC-Channel"), "profile %q: IRC-Channel %q should start with #", name, channel)
+				}
+			}
+		default:
+			problem(at("Chat"), "profile %q: unknown Chat %q (want slack, discord, matrix or irc)", name, profile.Chat)
+		}
+		if profile.Default_Channel == "" {
+			problem(at("Default-Channel"), "profile %q: Default-Channel is missing", name)
+		}
+		if profile.Default_Calendar == "" {
+			problem(at("Default-Calendar"), "profile %q: Default-Calendar is missing", name)
+		}
+		if len(profile.Calendar_Name) != len(profile.Calendar) {
+			problem(at("Calendar-Name"), "profile %q: %d Calendar-Name entries but %d Calendar entries; they must pair up",
+				name, len(profile.Calendar_Name), len(profile.Calendar))
+		}
+		for _, cal := range profile.Announce_Changes {
+			if strings.ToLower(cal) == "default" && profile.Default_Calendar == "" {
+				problem(at("Announce-Changes"), "profile %q: Announce-Changes uses the default calendar, but there isn't one", name)
+			}
+		}
+		switch strings.ToLower(profile.Events_Format) {
+		case "", "plain", "rich":
+		default:
+			problem(at("Events-Format"), "profile %q: unknown Events-Format %q (want plain or rich)", name, profile.Events_Format)
+		}
+		if profile.Thread_Events < 0 {
+			problem(at("Thread-Events"), "profile %q: Thread-Events can't be negative", name)
+		}
+		if profile.Announce_Interval < 0 {
+			problem(at("Announce-Interval"), "profile %q: Announce-Interval can't be negative", name)
+		}
+		if profile.Announce_Window < 0 {
+			problem(at("Announce-Window"), "profile %q: Announce-Window can't be negative", name)
+		}
+
+		for _, clock := range []struct{ variable, value string }{
+			{"Quiet-Start", profile.Quiet_Start},
+			{"Quiet-End", profile.Quiet_End},
+		} {
+			if _, ok := quiet_clock(clock.value); clock.value != "" && !ok {
+				problem(at(clock.variable), "profile %q: %s %q isn't a time like 22:00 or 7am", name, clock.variable, clock.value)
+			}
+		}
+		if (profile.Quiet_Start == "") != (profile.Quiet_End == "") {
+			problem(at("Quiet-Start"), "profile %q: Quiet-Start and Quiet-End must be set together", name)
+		}
+		for _, day := range profile.Quiet_Days {
+			if _, err := get_Wkday(strings.ToLower(day)); err != nil {
+				problem(at("Quiet-Days"), "profile %q: Quiet-Days %q isn't a day of the week", name, day)
+			}
+		}
+		for _, action := range []struct{ variable, value string }{
+			{"Quiet-Event", profile.Quiet_Event},
+			{"Quiet-Reminder", profile.Quiet_Reminder},
+			{"Quiet-Changes", profile.Quiet_Changes},
+		} {
+			known := false
+			for _, a := range quiet_actions {
+				known = known || strings.ToLower(action.value) == a
+			}
+			if !known {
+				problem(at(action.variable), "profile %q: %s %q should be send, drop, defer or digest", name, action.variable, action.value)
+			}
+		}
+	}
+
+	at := func(variable string) int {
+		return lines.line("log", "", variable)
+	}
+	if config.Log.Level != "" {
+		if _, err := parse_level(config.Log.Level); err != nil {
+			problem(at("Level"), "%s", err)
+		}
+	}
+	switch strings.ToLower(config.Log.Format) {
+	case "", "text", "json":
+	default:
+		problem(at("Format"), "unknown log format %q (want text or json)", config.Log.Format)
+	}
+	for _, entry := range config.Log.Component_Level {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			problem(at("Component-Level"), "component level %q should look like NOTIFIER=debug", entry)
+		} else if _, err := parse_level(parts[1]); err != nil {
+			problem(at("Component-Level"), "%s", err)
+		}
+	}
+	for _, limit := range []struct {
+		variable string
+		value    int
+	}{
+		{"Max-Size", config.Log.Max_Size},
+		{"Max-Age", config.Log.Max_Age},
+		{"Keep", config.Log.Keep},
+		{"Keep-Days", config.Log.Keep_Days},
+	} {
+		if limit.value < 0 {
+			problem(at(limit.variable), "%s can't be negative", limit.variable)
+		}
+	}
+
+	return problems
+}
+
+// configured_calendars lists every calendar id the active profile refers to.
+func configured_calendars() []string {
+	var calendars []string
+	seen := make(map[string]bool)
+	add := func(id string) {
+		if id != "" && !seen[id] {
+			seen[id] = true
+			calendars = append(calendars, id)
+		}
+	}
+
+	add(profile().Default_Calendar)
+	for _, id := range profile().Calendar {
+		add(id)
+	}
+	for _, name := range profile().Announce_Changes {
+		add(resolve_calendar(name))
+	}
+	return calendars
+}
+
+// probe_calendars checks that every calendar the active profile uses can be
+// read with the service account's key.
+func probe_calendars(gApi *http.Client) []string {
+	var problems []string
+	for _, id := range configured_calendars() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		_, err := call(ctx, gApi, calendar_request("/calendars/{calendarId}").Param("calendarId", id))
+		cancel()
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("calendar %s: %s", id, err))
+		}
+	}
+	return problems
+}
+
+// check_config is the check-config command: it reports every problem with the
+// config and key files (and, with -probe-calendars, the calendars themselves)
+// and returns the exit status.
+func check_config(probe bool) int {
+	config, err := load_config(CFGFILE)
+	if err != nil {
+		fmt.Println(CFGFILE + ": " + err.Error())
+		return 1
+	}
+	set_config(config)
+	redact_secrets(config_secrets(config))
+
+	failed := false
+	for _, p := range validate_config(&CONFIG, CFGFILE, TEAM, true) {
+		fmt.Println(p)
+		failed = true
+	}
+	for _, p := range check_secret_files(&CONFIG) {
+		fmt.Println(p)
+		failed = true
+	}
+
+	gApi, err := setupAPIClient(KEY, "https://www.googleapis.com/auth/calendar")
+	if err != nil {
+		fmt.Println(KEY + ": " + err.Error())
+		failed = true
+	}
+
+	if probe && gApi != nil && profile() != nil {
+		for _, p := range probe_calendars(gApi) {
+			fmt.Println(p)
+			failed = true
+		}
+	}
+
+	if failed {
+		return 1
+	}
+	fmt.Println(CFGFILE + ": ok")
+	return 0
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// consoleAdapter is a chat platform on the terminal: lines typed on stdin
+// come from CONSOLE_USER in the default channel, or in a DM with -dm, and
+// everything the bot posts is printed to stdout.
+type consoleAdapter struct {
+	sync.Mutex
+	next int
+}
+
+// Run returns at the end of stdin. incoming must be unbuffered: handing over
+// one last empty message proves the final command has been dealt with.
+func (c *consoleAdapter) Run(ctx context.Context, incoming chan Message) {
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+
+	chat_connected()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case line, ok := <-lines:
+			if !ok {
+				select {
+				case incoming <- Message{}:
+				case <-ctx.Done():
+				}
+				return
+			}
+			c.Lock()
+			c.next++
+			id := strconv.Itoa(c.next)
+			c.Unlock()
+			msg := Message{Id: id, UserId: CONSOLE_USER, ChannelId: profile().Default_Channel, Text: line}
+			if CONSOLE_DM {
+				msg.ChannelId, msg.Direct = "D"+CONSOLE_USER, true
+			}
+			incoming <- msg
+		}
+	}
+}
+
+func (c *consoleAdapter) Connected() bool {
+	return true
+}
+
+func (c *consoleAdapter) Send(msg Message) (string, error) {
+	c.Lock()
+	defer c.Unlock()
+	c.next++
+	text := msg.Text
+	if len(msg.Blocks) > 0 {
+		// Show rich messages the way they're laid out.
+		var sections []string
+		for _, block := range msg.Blocks {
+			sections = append(sections, "== "+block.Heading+" ==\n"+strings.Join(block.Lines, "\n"))
+		}
+		text = strings.Join(sections, "\n")
+	}
+	if msg.ThreadId != "" {
+		fmt.Printf("[%s, thread #%s] %s\n", msg.ChannelId, msg.ThreadId, text)
+	} else {
+		fmt.Printf("[%s] %s\n", msg.ChannelId, text)
+	}
+	return strconv.Itoa(c.next), nil
+}
+
+func (c *consoleAdapter) Edit(channel, id, text string) error {
+	fmt.Printf("[%s] (edited #%s) %s\n", channel, id, text)
+	return nil
+}
+
+func (c *consoleAdapter) React(channel, id, emoji string) error {
+	fmt.Printf("[%s] (:%s: on #%s)\n", channel, emoji, id)
+	return nil
+}
+
+func (c *consoleAdapter) DM(user string) (string, error) {
+	return "D" + user, nil
+}
+
+func (c *consoleAdapter) User(id string) (ChatUser, error) {
+	return ChatUser{Id: id, Name: id}, nil
+}
+
+func (c *consoleAdapter) Users() ([]ChatUser, error) {
+	return []ChatUser{{Id: CONSOLE_USER, Name: CONSOLE_USER}}, nil
+}
+
+func (c *consoleAdapter) Channel(name string) (string, error) {
+	return "C" + name, nil
+}
+
+// console runs the bot's commands against lines typed on stdin. Subscriptions
+// and reminders go to a scratch directory unless their files were given on
+// the command line.
+func console() int {
+	log := logger("CONSOLE")
+	if err := setup_config(); err != nil {
+		fmt.Fprintln(os.Stderr, redact(err.Error()))
+		return 1
+	}
+
+	var gApi *http.Client
+	var err error
+	if FAKE_CALENDAR != "" {
+		CALENDAR_API, err = serve_fake_calendar(FAKE_CALENDAR)
+		gApi = http.DefaultClient
+	} else {
+		gApi, err = setupAPIClient(KEY, "https://www.googleapis.com/auth/calendar")
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, redact("Error setting up the calendar: "+err.Error()))
+		return 1
+	}
+
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	scratch, err := ioutil.TempDir("", "calbot-console")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error creating a scratch directory: "+err.Error())
+		return 1
+	}
+	defer os.RemoveAll(scratch)
+	if !given["subscriptions"] && !given["s"] {
+		SUBFILE = filepath.Join(scratch, "subscriptions.json")
+	}
+	if !given["reminders"] && !given["r"] {
+		REMFILE = filepath.Join(scratch, "reminders.json")
+	}
+	if err := load_subscriptions(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error at loading subscriptions: "+err.Error())
+		return 1
+	}
+	if err := load_reminders(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error at loading reminders: "+err.Error())
+		return 1
+	}
+	if err := prep_quotes(); err != nil {
+		log.Warn("Couldn't load quotes", "error", err)
+	}
+
+	CHAT = &consoleAdapter{}
+	ctx := lifecycle_context()
+	chSender := make(chan InternalMessage, 10)
+	chIncoming := make(chan Message)
+	senderDone := make(chan bool)
+	go handle_signals(ctx)
+	go process(ctx, chIncoming, chSender, gApi)
+	go sender(ctx, chSender, senderDone)
+	go reminder_scheduler(ctx, chSender)
+
+	where := profile().Default_Channel
+	if CONSOLE_DM {
+		where = "a direct message"
+	}
+	fmt.Fprintf(os.Stderr, "Talking to profile %s as %s in %s. Try ^events today; Ctrl-D to quit.\n", TEAM, CONSOLE_USER, where)
+	CHAT.Run(ctx, chIncoming)
+	shutdown(false)
+	<-senderDone
+	return 0
+}
@@ -0,0 +1,540 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/net/websocket"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// DISCORD_API is the default Discord REST API. A profile's Discord-API can
+// point somewhere else, e.g. at a fake server for testing; the gateway URL is
+// asked for from the same place.
+var DISCORD_API = "https://discord.com/api/v10"
+
+const (
+	discord_intents     = 1<<0 | 1<<9 | 1<<12 | 1<<15 // guilds, guild messages, DMs, message content
+	discord_max_message = 2000
+
+	discord_max_thread_name = 100
+	discord_thread_exists   = 160004 // a thread has already been created for this message
+
+	discord_op_dispatch        = 0
+	discord_op_heartbeat       = 1
+	discord_op_identify        = 2
+	discord_op_reconnect       = 7
+	discord_op_invalid_session = 9
+	discord_op_hello           = 10
+	discord_op_heartbeat_ack   = 11
+)
+
+// discordAdapter receives from the Discord gateway and sends through the REST
+// API. Channel and user ids in the profile are Discord snowflakes.
+type discordAdapter struct {
+	token  string
+	guild  string
+	api    string
+	client *http.Client
+
+	sync.Mutex
+	connected bool
+	self      string
+}
+
+type discordPayload struct {
+	Op   int             `json:"op"`
+	Data json.RawMessage `json:"d,omitempty"`
+	Seq  *int64          `json:"s,omitempty"`
+	Type string          `json:"t,omitempty"`
+}
+
+func new_discord_adapter(token, guild, api string) *discordAdapter {
+	if api == "" {
+		api = DISCORD_API
+	}
+	return &discordAdapter{token: token, guild: guild, api: strings.TrimSuffix(api, "/"), client: &http.Client{Timeout: 15 * time.Second}}
+}
+
+// call makes a REST request. Discord's 429s and 5xxs are temporary; any other
+// refusal is not.
+func (d *discordAdapter) call(method, path string, body, reply interface{}) error {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	request, err := http.NewRequest(method, d.api+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", "Bot "+d.token)
+	request.Header.Set("User-Agent", "DiscordBot (dx_cal_bot, "+VERSION+")")
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	response, err := d.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	text, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		var refusal struct {
+			Code int `json:"code"`
+		}
+		json.Unmarshal(text, &refusal)
+		return &chatError{
+			Message:   fmt.Sprintf("discord %s %s: %d %s", method, path, response.StatusCode, strings.TrimSpace(string(text))),
+			Temporary: response.StatusCode == 429 || response.StatusCode >= 500,
+			Code:      refusal.Code,
+		}
+	}
+	if reply != nil && len(text) > 0 {
+		return json.Unmarshal(text, reply)
+	}
+	return nil
+}
+
+func (d *discordAdapter) Connected() bool {
+	d.Lock()
+	defer d.Unlock()
+	return d.connected
+}
+
+func (d *discordAdapter) set_connected(connected bool, self string) {
+	d.Lock()
+	d.connected = connected
+	d.self = self
+	d.Unlock()
+}
+
+// Run keeps a gateway connection open, reconnecting with backoff whenever it
+// drops.
+func (d *discordAdapter) Run(ctx context.Context, incoming chan Message) {
+	log := logger("DISCORD")
+	attempt := 0
+	for {
+		started := time.Now()
+		err := d.session(ctx, incoming)
+		d.set_connected(false, "")
+		if ctx.Err() != nil {
+			return
+		}
+
+		if time.Since(started) > time.Minute {
+			attempt = 0
+		}
+		attempt++
+		wait := backoff(attempt, rtm_min_backoff, rtm_max_backoff)
+		log.Warn("Lost connection", "reason", err, "retry_in", wait)
+		CHAT_RECONNECTS.Inc()
+		if !sleep(ctx, wait) {
+			return
+		}
+	}
+}
+
+// session runs one gateway connection until it fails or ctx is done.
+func (d *discordAdapter) session(ctx context.Context, incoming chan Message) error {
+	log := logger("DISCORD")
+	var gateway struct {
+		URL string `json:"url"`
+	}
+	if err := d.call("GET", "/gateway/bot", nil, &gateway); err != nil {
+		return err
+	}
+	dial, err := url.Parse(gateway.URL)
+	if err != nil {
+		return err
+	}
+	if dial.Path == "" {
+		dial.Path = "/"
+	}
+	dial.RawQuery = "v=10&encoding=json"
+	ws, err := websocket.Dial(dial.String(), "", d.api)
+	if err != nil {
+		return err
+	}
+	defer ws.Close()
+
+	var write sync.Mutex
+	send := func(op int, data interface{}) error {
+		raw, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		write.Lock()
+		defer write.Unlock()
+		ws.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		return websocket.JSON.Send(ws, discordPayload{Op: op, Data: raw})
+	}
+
+	var hello discordPayload
+	if err := websocket.JSON.Receive(ws, &hello); err != nil {
+		return err
+	}
+	var interval struct {
+		Heartbeat int64 `json:"heartbeat_interval"`
+	}
+	if hello.Op != discord_op_hello || json.Unmarshal(hello.Data, &interval) != nil || interval.Heartbeat <= 0 {
+		return fmt.Errorf("expected hello from the gateway, got op %d", hello.Op)
+	}
+
+	err = send(discord_op_identify, map[string]interface{}{
+		"token":      d.token,
+		"intents":    discord_intents,
+		"properties": map[string]string{"os": "linux", "browser": "dx_cal_bot", "device": "dx_cal_bot"},
+	})
+	if err != nil {
+		return err
+	}
+
+	// The heartbeat and the reader both report why the connection ended on
+	// lost.
+	sessionCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	lost := make(chan error, 2)
+	var seq int64 = -1
+	var acked = true
+	var state sync.Mutex
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(interval.Heartbeat) * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-sessionCtx.Done():
+				return
+			case <-ticker.C:
+				state.Lock()
+				missed, last := !acked, seq
+				acked = false
+				state.Unlock()
+				if missed {
+					lost <- fmt.Errorf("no heartbeat ack")
+					return
+				}
+				if err := send(discord_op_heartbeat, nullable_seq(last)); err != nil {
+					lost <- err
+					return
+				}
+			}
+		}
+	}()
+
+	go func() {
+		for {
+			var payload discordPayload
+			if err := websocket.JSON.Receive(ws, &payload); err != nil {
+				lost <- err
+				return
+			}
+			if payload.Seq != nil {
+				state.Lock()
+				seq = *payload.Seq
+				state.Unlock()
+			}
+
+			switch payload.Op {
+			case discord_op_heartbeat:
+				state.Lock()
+				last := seq
+				state.Unlock()
+				send(discord_op_heartbeat, nullable_seq(last))
+			case discord_op_heartbeat_ack:
+				state.Lock()
+				acked = true
+				state.Unlock()
+			case discord_op_reconnect:
+				lost <- fmt.Errorf("gateway asked us to reconnect")
+				return
+			case discord_op_invalid_session:
+				lost <- fmt.Errorf("gateway invalidated the session")
+				return
+			case discord_op_dispatch:
+				d.dispatch(sessionCtx, payload, incoming)
+			default:
+				log.Debug("Unexpected / Don't Care", "op", payload.Op)
+			}
+		}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-lost:
+		return err
+	}
+}
+
+func nullable_seq(seq int64) interface{} {
+	if seq < 0 {
+		return nil
+	}
+	return seq
+}
+
+func (d *discordAdapter) dispatch(ctx context.Context, payload discordPayload, incoming chan Message) {
+	log := logger("DISCORD")
+	switch payload.Type {
+	case "READY":
+		var ready struct {
+			User struct {
+				Id string `json:"id"`
+			} `json:"user"`
+		}
+		json.Unmarshal(payload.Data, &ready)
+		d.set_connected(true, ready.User.Id)
+		log.Info("Connected to Discord", "user", ready.User.Id)
+		chat_connected()
+	case "MESSAGE_CREATE":
+		var message struct {
+			Id        string `json:"id"`
+			ChannelId string `json:"channel_id"`
+			GuildId   string `json:"guild_id"`
+			Content   string `json:"content"`
+			Author    struct {
+				Id  string `json:"id"`
+				Bot bool   `json:"bot"`
+			} `json:"author"`
+		}
+		if err := json.Unmarshal(payload.Data, &message); err != nil {
+			log.Warn("Couldn't read message", "error", err)
+			return
+		}
+		d.Lock()
+		self := d.self
+		d.Unlock()
+		if message.Author.Bot || message.Author.Id == self {
+			return
+		}
+		select {
+		case incoming <- Message{Id: message.Id, UserId: message.Author.Id, ChannelId: message.ChannelId, Text: message.Content, Direct: message.GuildId == ""}:
+		case <-ctx.Done():
+		}
+	}
+}
+
+// discord_text turns the Slack markup the bot writes into Discord's. User
+// and channel mentions are already the same.
+func discord_text(text string) string {
+	text = slack_link_rx.ReplaceAllString(text, "$2 (<$1>)")
+	return slack_bold_rx.ReplaceAllString(text, "$1**$2**")
+}
+
+// discord_chunks splits text into messages short enough for Discord, breaking
+// between lines where it can. A ``` block that gets cut in two is closed at
+// the end of one message and opened again at the start of the next.
+func discord_chunks(text string) []string {
+	const fence = "```"
+	closing := len("\n" + fence)
+
+	var chunks, lines []string
+	size, fenced := 0, false
+	flush := func() {
+		chunk := strings.Join(lines, "\n")
+		if fenced {
+			chunk += "\n" + fence
+		}
+		chunks = append(chunks, chunk)
+		lines, size = nil, 0
+		if fenced {
+			lines, size = []string{fence}, len(fence)
+		}
+	}
+	for _, line := range strings.Split(text, "\n") {
+		for _, piece := range discord_split_line(line, discord_max_message-len(fence+"\n")-closing) {
+			length := utf8.RuneCountInString(piece)
+			toggles := strings.Count(piece, fence)%2 == 1
+			limit := discord_max_message
+			if fenced != toggles {
+				limit -= closing
+			}
+			if lines != nil && size+1+length > limit {
+				flush()
+			}
+			if lines != nil {
+				size++
+			}
+			lines = append(lines, piece)
+			size += length
+			if toggles {
+				fenced = !fenced
+			}
+		}
+	}
+	fenced = false
+	flush()
+	return chunks
+}
+
+// discord_split_line breaks a line into pieces of at most max characters, between
+// words where it can.
+func discord_split_line(line string, max int) []string {
+	var pieces []string
+	runes := []rune(line)
+	for len(runes) > max {
+		cut := max
+		for i := max; i > 0; i-- {
+			if runes[i] == ' ' {
+				cut = i
+				break
+			}
+		}
+		pieces = append(pieces, strings.TrimRight(string(runes[:cut]), " "))
+		runes = []rune(strings.TrimLeft(string(runes[cut:]), " "))
+	}
+	return append(pieces, string(runes))
+}
+
+// Send posts to a thread by starting one on the message ThreadId names. A
+// Discord thread is a channel with the same id as the message it started
+// from, so if it is already there the post goes straight to it. Messages
+// posted inside a thread already arrive with the thread as their channel.
+// If the thread can't be started for any other reason, e.g. the bot isn't
+// allowed to, the reply goes to the channel instead. Text too long for one
+// message is sent as several, and the first one's id is returned.
+func (d *discordAdapter) Send(msg Message) (string, error) {
+	channel := msg.ChannelId
+	if msg.ThreadId != "" {
+		name := strings.SplitN(plain_text(msg.Text), "\n", 2)[0]
+		if runes := []rune(name); len(runes) > discord_max_thread_name {
+			name = string(runes[:discord_max_thread_name])
+		}
+		err := d.call("POST", "/channels/"+url.PathEscape(channel)+"/messages/"+url.PathEscape(msg.ThreadId)+"/threads", map[string]string{"name": name}, nil)
+		if e, ok := err.(*chatError); ok && e.Code == discord_thread_exists {
+			err = nil
+		}
+		switch {
+		case err == nil:
+			channel = msg.ThreadId
+		case temporary(err):
+			return "", err
+		default:
+			logger("DISCORD").Warn("Couldn't start a thread, replying in the channel", "channel", channel, "error", err)
+		}
+	}
+	first := ""
+	for _, chunk := range discord_chunks(discord_text(msg.Text)) {
+		id, err := d.post(channel, chunk)
+		if err != nil {
+			return first, err
+		}
+		if first == "" {
+			first = id
+		}
+	}
+	return first, nil
+}
+
+func (d *discordAdapter) post(channel, content string) (string, error) {
+	var reply struct {
+		Id string `json:"id"`
+	}
+	err := d.call("POST", "/channels/"+url.PathEscape(channel)+"/messages", map[string]string{"content": content}, &reply)
+	return reply.Id, err
+}
+
+// Edit replaces the message with the start of text; whatever doesn't fit
+// follows it as new messages.
+func (d *discordAdapter) Edit(channel, id, text string) error {
+	chunks := discord_chunks(discord_text(text))
+	if err := d.call("PATCH", "/channels/"+url.PathEscape(channel)+"/messages/"+url.PathEscape(id), map[string]string{"content": chunks[0]}, nil); err != nil {
+		return err
+	}
+	for _, chunk := range chunks[1:] {
+		if _, err := d.post(channel, chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// React takes a unicode emoji, or a custom one as name:id.
+func (d *discordAdapter) React(channel, id, emoji string) error {
+	return d.call("PUT", "/channels/"+url.PathEscape(channel)+"/messages/"+url.PathEscape(id)+"/reactions/"+url.PathEscape(emoji)+"/@me", nil, nil)
+}
+
+func (d *discordAdapter) DM(user string) (string, error) {
+	var channel struct {
+		Id string `json:"id"`
+	}
+	err := d.call("POST", "/users/@me/channels", map[string]string{"recipient_id": user}, &channel)
+	return channel.Id, err
+}
+
+type discordUser struct {
+	Id       string `json:"id"`
+	Username string `json:"username"`
+	Bot      bool   `json:"bot"`
+}
+
+func (d *discordAdapter) User(id string) (ChatUser, error) {
+	var user discordUser
+	if err := d.call("GET", "/users/"+url.PathEscape(id), nil, &user); err != nil {
+		return ChatUser{}, err
+	}
+	return ChatUser{Id: user.Id, Name: user.Username}, nil
+}
+
+// Users lists the guild's members. Discord doesn't share emails or
+// timezones, so attendees can't be matched up with them.
+func (d *discordAdapter) Users() ([]ChatUser, error) {
+	if d.guild == "" {
+		return nil, nil
+	}
+	var users []ChatUser
+	after := "0"
+	for {
+		var members []struct {
+			User discordUser `json:"user"`
+		}
+		err := d.call("GET", "/guilds/"+url.PathEscape(d.guild)+"/members?limit=1000&after="+after, nil, &members)
+		if err != nil {
+			return nil, err
+		}
+		for _, member := range members {
+			if !member.User.Bot {
+				users = append(users, ChatUser{Id: member.User.Id, Name: member.User.Username})
+			}
+			after = member.User.Id
+		}
+		if len(members) < 1000 {
+			return users, nil
+		}
+	}
+}
+
+func (d *discordAdapter) Channel(name string) (string, error) {
+	if d.guild == "" {
+		return "", fmt.Errorf("I can only find channels by name if Discord-Guild is set")
+	}
+	var channels []struct {
+		Id   string `json:"id"`
+		Name string `json:"name"`
+	}
+	if err := d.call("GET", "/guilds/"+url.PathEscape(d.guild)+"/channels", nil, &channels); err != nil {
+		return "", err
+	}
+	for _, channel := range channels {
+		if channel.Name == name {
+			return channel.Id, nil
+		}
+	}
+	return "", fmt.Errorf("I don't know a channel called #%s", name)
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"golang.org/x/net/websocket"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// fakeDiscord is a REST API and gateway in one server. REST calls are
+// recorded, and every gateway connection is handed to the test to drive.
+type fakeDiscord struct {
+	server  *httptest.Server
+	conns   chan *websocket.Conn
+	release chan struct{}
+
+	sync.Mutex
+	calls []string
+}
+
+func new_fake_discord(t *testing.T) *fakeDiscord {
+	f := &fakeDiscord{conns: make(chan *websocket.Conn, 1), release: make(chan struct{})}
+	mux := http.NewServeMux()
+	mux.Handle("/gateway", websocket.Handler(func(ws *websocket.Conn) {
+		f.conns <- ws
+		<-f.release
+	}))
+	mux.HandleFunc("/api/", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		path := strings.TrimPrefix(r.URL.EscapedPath(), "/api")
+		f.Lock()
+		f.calls = append(f.calls, r.Method+" "+path+" "+string(body))
+		id := len(f.calls)
+		f.Unlock()
+
+		switch {
+		case path == "/gateway/bot":
+			json.NewEncoder(w).Encode(map[string]string{"url": "ws" + strings.TrimPrefix(f.server.URL, "http") + "/gateway"})
+		case strings.HasSuffix(path, "/messages"):
+			json.NewEncoder(w).Encode(map[string]string{"id": "M" + strconv.Itoa(id)})
+		case strings.HasSuffix(path, "/EXISTS/threads"):
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"code":160004,"message":"A thread has already been created for this message"}`))
+		case strings.HasSuffix(path, "/LOCKED/threads"):
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"code":50013,"message":"Missing Permissions"}`))
+		default:
+			w.Write([]byte("{}"))
+		}
+	})
+	f.server = httptest.NewServer(mux)
+	t.Cleanup(f.server.Close)
+	t.Cleanup(func() { close(f.release) })
+	return f
+}
+
+func (f *fakeDiscord) adapter() *discordAdapter {
+	return new_discord_adapter("TOKEN", "", f.server.URL+"/api")
+}
+
+func (f *fakeDiscord) requests() []string {
+	f.Lock()
+	defer f.Unlock()
+	return append([]string(nil), f.calls...)
+}
+
+// connect waits for the adapter to open the gateway and says hello.
+func (f *fakeDiscord) connect(t *testing.T, heartbeat time.Duration) *websocket.Conn {
+	select {
+	case ws := <-f.conns:
+		gateway_send(t, ws, discord_op_hello, "", map[string]int64{"heartbeat_interval": int64(heartbeat / time.Millisecond)})
+		return ws
+	case <-time.After(5 * time.Second):
+		t.Fatal("the adapter never connected to the gateway")
+	}
+	return nil
+}
+
+func gateway_send(t *testing.T, ws *websocket.Conn, op int, event string, data interface{}) {
+	raw, _ := json.Marshal(data)
+	if err := websocket.JSON.Send(ws, discordPayload{Op: op, Type: event, Data: raw}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// gateway_expect reads the next payload, which must be op.
+func gateway_expect(t *testing.T, ws *websocket.Conn, op int) discordPayload {
+	var payload discordPayload
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := websocket.JSON.Receive(ws, &payload); err != nil {
+		t.Fatalf("waiting for op %d: %s", op, err)
+	}
+	if payload.Op != op {
+		t.Fatalf("got op %d, want %d", payload.Op, op)
+	}
+	return payload
+}
+
+// start_session runs one gateway session in the background and returns what
+// it ended with.
+func start_session(d *discordAdapter, incoming chan Message) (context.CancelFunc, chan error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	ended := make(chan error, 1)
+	go func() { ended <- d.session(ctx, incoming) }()
+	return cancel, ended
+}
+
+func wait_ended(t *testing.T, ended chan error) error {
+	select {
+	case err := <-ended:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("the session didn't end")
+	}
+	return nil
+}
+
+func TestDiscordIdentifyAndReady(t *testing.T) {
+	f := new_fake_discord(t)
+	d := f.adapter()
+	cancel, ended := start_session(d, make(chan Message))
+	defer cancel()
+
+	ws := f.connect(t, time.Minute)
+	identify := gateway_expect(t, ws, discord_op_identify)
+	var login struct {
+		Token   string `json:"token"`
+		Intents int    `json:"intents"`
+	}
+	json.Unmarshal(identify.Data, &login)
+	if login.Token != "TOKEN" || login.Intents != discord_intents {
+		t.Errorf("identified with %s", identify.Data)
+	}
+	if d.Connected() {
+		t.Error("connected before READY")
+	}
+
+	gateway_send(t, ws, discord_op_dispatch, "READY", map[string]interface{}{"user": map[string]string{"id": "BOT"}})
+	for deadline := time.Now().Add(5 * time.Second); !d.Connected(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("not connected after READY")
+		}
+	}
+
+	cancel()
+	if err := wait_ended(t, ended); err != context.Canceled {
+		t.Errorf("session ended with %v", err)
+	}
+}
+
+func TestDiscordHeartbeat(t *testing.T) {
+	f := new_fake_discord(t)
+	cancel, ended := start_session(f.adapter(), make(chan Message))
+	defer cancel()
+
+	ws := f.connect(t, 100*time.Millisecond)
+	gateway_expect(t, ws, discord_op_identify)
+	gateway_send(t, ws, discord_op_dispatch, "READY", map[string]interface{}{"user": map[string]string{"id": "BOT"}})
+
+	// Acked heartbeats keep the session going, and carry the last sequence
+	// number seen.
+	seq := int64(7)
+	if err := websocket.JSON.Send(ws, discordPayload{Op: discord_op_dispatch, Type: "TYPING_START", Data: json.RawMessage("{}"), Seq: &seq}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		beat := gateway_expect(t, ws, discord_op_heartbeat)
+		if string(beat.Data) != "7" {
+			t.Errorf("heartbeat carried %s, want 7", beat.Data)
+		}
+		gateway_send(t, ws, discord_op_heartbeat_ack, "", nil)
+	}
+	select {
+	case err := <-ended:
+		t.Fatalf("session ended while heartbeats were acked: %v", err)
+	default:
+	}
+
+	// The next one goes unanswered, so the one after finds it missed.
+	gateway_expect(t, ws, discord_op_heartbeat)
+	if err := wait_ended(t, ended); err == nil || !strings.Contains(err.Error(), "ack") {
+		t.Errorf("session ended with %v, want a missed ack", err)
+	}
+}
+
+func TestDiscordReconnectOps(t *testing.T) {
+	for _, op := range []int{discord_op_reconnect, discord_op_invalid_session} {
+		f := new_fake_discord(t)
+		cancel, ended := start_session(f.adapter(), make(chan Message))
+
+		ws := f.connect(t, time.Minute)
+		gateway_expect(t, ws, discord_op_identify)
+		gateway_send(t, ws, op, "", false)
+		if err := wait_ended(t, ended); err == nil || err == context.Canceled {
+			t.Errorf("op %d: session ended with %v", op, err)
+		}
+		cancel()
+	}
+}
+
+func TestDiscordMessages(t *testing.T) {
+	f := new_fake_discord(t)
+	incoming := make(chan Message, 10)
+	cancel, _ := start_session(f.adapter(), incoming)
+	defer cancel()
+
+	ws := f.connect(t, time.Minute)
+	gateway_expect(t, ws, discord_op_identify)
+	gateway_send(t, ws, discord_op_dispatch, "READY", map[string]interface{}{"user": map[string]string{"id": "BOT"}})
+
+	message := func(id, guild, author string, bot bool) map[string]interface{} {
+		return map[string]interface{}{
+			"id": id, "channel_id": "C" + id, "guild_id": guild, "content": "^events " + id,
+			"author": map[string]interface{}{"id": author, "bot": bot},
+		}
+	}
+	gateway_send(t, ws, discord_op_dispatch, "MESSAGE_CREATE", message("1", "G", "BOT", false))
+	gateway_send(t, ws, discord_op_dispatch, "MESSAGE_CREATE", message("2", "G", "OTHERBOT", true))
+	gateway_send(t, ws, discord_op_dispatch, "MESSAGE_CREATE", message("3", "G", "U1", false))
+	gateway_send(t, ws, discord_op_dispatch, "MESSAGE_CREATE", message("4", "", "U2", false))
+
+	want := []Message{
+		{Id: "3", UserId: "U1", ChannelId: "C3", Text: "^events 3"},
+		{Id: "4", UserId: "U2", ChannelId: "C4", Text: "^events 4", Direct: true},
+	}
+	for _, w := range want {
+		select {
+		case got := <-incoming:
+			if got.Id != w.Id || got.UserId != w.UserId || got.ChannelId != w.ChannelId || got.Text != w.Text || got.Direct != w.Direct {
+				t.Errorf("got %+v, want %+v", got, w)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("never got message %s", w.Id)
+		}
+	}
+}
+
+func TestDiscordSend(t *testing.T) {
+	f := new_fake_discord(t)
+	d := f.adapter()
+
+	if _, err := d.Send(Message{ChannelId: "C", Text: "*hi* there"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Send(Message{ChannelId: "C", ThreadId: "T", Text: "In a thread\nsecond line"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Send(Message{ChannelId: "C", ThreadId: "EXISTS", Text: "Again"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Send(Message{ChannelId: "C", ThreadId: "LOCKED", Text: "No threads here"}); err != nil {
+		t.Fatal(err)
+	}
+	long := strings.Repeat("é", 120)
+	if _, err := d.Send(Message{ChannelId: "C", ThreadId: "T2", Text: long}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		`POST /channels/C/messages {"content":"**hi** there"}`,
+		`POST /channels/C/messages/T/threads {"name":"In a thread"}`,
+		`POST /channels/T/messages {"content":"In a thread\nsecond line"}`,
+		`POST /channels/C/messages/EXISTS/threads {"name":"Again"}`,
+		`POST /channels/EXISTS/messages {"content":"Again"}`,
+		`POST /channels/C/messages/LOCKED/threads {"name":"No threads here"}`,
+		`POST /channels/C/messages {"content":"No threads here"}`,
+		`POST /channels/C/messages/T2/threads {"name":"` + strings.Repeat("é", 100) + `"}`,
+		`POST /channels/T2/messages {"content":"` + long + `"}`,
+	}
+	got := f.requests()
+	if len(got) != len(want) {
+		t.Fatalf("got requests %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("request %d = %s, want %s", i, got[i], want[i])
+		}
+	}
+}
+
+func TestDiscordSendLong(t *testing.T) {
+	f := new_fake_discord(t)
+	d := f.adapter()
+
+	text := "``` Start | End | Event\n" + strings.Repeat("Mon 09:00 | 09:15 | Standup\n", 200) + "```"
+	id, err := d.Send(Message{ChannelId: "C", Text: text})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "M1" {
+		t.Errorf("Send returned %q, want the first message's id", id)
+	}
+	if posts := len(f.requests()); posts < 3 {
+		t.Errorf("%d characters went in %d messages", len(text), posts)
+	}
+}
+
+func TestDiscordChunks(t *testing.T) {
+	long_line := strings.Repeat("word ", 1000)
+	table := "``` Start | End\n" + strings.Repeat("Mon 09:00 | 10:00 | Standup é\n", 150) + "```\nafterwards"
+
+	tests := []struct {
+		name   string
+		text   string
+		chunks int
+	}{
+		{"short", "hello", 1},
+		{"just fits", strings.Repeat("123456789\n", discord_max_message/10-1) + "123456789", 1},
+		{"one line over", strings.Repeat("123456789\n", discord_max_message/10) + "1", 2},
+		{"long line", long_line, 3},
+		{"table", table, 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chunks := discord_chunks(test.text)
+			if len(chunks) != test.chunks {
+				t.Errorf("got %d chunks, want %d", len(chunks), test.chunks)
+			}
+			for i, chunk := range chunks {
+				if n := utf8.RuneCountInString(chunk); n > discord_max_message {
+					t.Errorf("chunk %d is %d characters", i, n)
+				}
+				if strings.Count(chunk, "```")%2 != 0 {
+					t.Errorf("chunk %d leaves a ``` block open", i)
+				}
+			}
+			joined := strings.Replace(strings.Join(chunks, "\n"), "\n```\n```\n", "\n", -1)
+			if strings.Fields(joined)[0] != strings.Fields(test.text)[0] || len(strings.Fields(joined)) != len(strings.Fields(test.text)) {
+				t.Error("words were lost or added")
+			}
+		})
+	}
+}
@@ -1,13 +1,12 @@
 package main
 
 import (
-	"bufio"
-	"code.google.com/p/gcfg"
+	"context"
 	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"github.com/nlopes/slack"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"golang.org/x/oauth2/jwt"
@@ -16,52 +15,125 @@ import (
 	"math/big"
 	"net/http"
 	"os"
-	"os/exec"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 type ConfigFile struct {
-	Profile map[string]*struct {
-		Slack            string
-		Admin            []string
-		Default_Channel  string
-		Default_Calendar string
-		Calendar_Name    []string
-		Calendar         []string
+	Log struct {
+		Level           string
+		Format          string
+		Component_Level []string
+
+		Max_Size  int
+		Max_Age   int
+		Keep      int
+		Keep_Days int
 	}
+	Profile map[string]*Profile
+}
+
+// Profile is one [profile "name"] section: a chat team and its calendars.
+type Profile struct {
+	Chat       string
+	Slack      string
+	Slack_File string
+
+	Slack_Listen              string
+	Slack_Signing_Secret      string
+	Slack_Signing_Secret_File string
+
+	Discord       string
+	Discord_File  string
+	Discord_Guild string
+	Discord_API   string
+
+	Matrix            string
+	Matrix_File       string
+	Matrix_Homeserver string
+
+	IRC_Server        string
+	IRC_TLS           bool
+	IRC_Nick          string
+	IRC_Password      string
+	IRC_Password_File string
+	IRC_Channel       []string
+
+	// ^events replies longer than this many lines go in a thread under the
+	// command instead of the channel. 0 never threads them.
+	Thread_Events int
+	// Events_Format is how ^events lists events: "plain", a table in a code
+	// block, or "rich", a section per day for chats that can show one.
+	// ^events --plain and --rich choose for a single command.
+	Events_Format string
+
+	Admin            []string
+	Default_Channel  string
+	Default_Calendar string
+	Calendar_Name    []string
+	Calendar         []string
+
+	Announce_Changes  []string
+	Announce_Interval int
+	Announce_Window   int
+
+	Quiet_Start    string
+	Quiet_End      string
+	Quiet_Days     []string
+	Quiet_Event    string
+	Quiet_Reminder string
+	Quiet_Changes  string
 }
 
 type InternalMessage struct {
-	*slack.MessageEvent
-	Outgoing *slack.OutgoingMessage
+	*Message
+	Outgoing *Message
 }
 
 func allocInternalMessage() InternalMessage {
-	outgoing := new(slack.OutgoingMessage)
-	outgoing.Id = int(time.Now().UnixNano())
-	outgoing.ChannelId = CONFIG.Profile[TEAM].Default_Channel
-	outgoing.Type = "message"
+	outgoing := new(Message)
+	outgoing.ChannelId = profile().Default_Channel
 
-	return InternalMessage{new(slack.MessageEvent), outgoing}
+	return InternalMessage{new(Message), outgoing}
 }
 
-func allocWithBoth(incoming *slack.MessageEvent, outgoing *slack.OutgoingMessage) InternalMessage {
+var DM_CHANNELS = make(map[string]string)
+var DM_LOCK sync.Mutex
+
+// dm_channel returns the id of the direct message channel with user, opening
+// it the first time it's needed.
+func dm_channel(user string) (string, error) {
+	DM_LOCK.Lock()
+	defer DM_LOCK.Unlock()
+
+	if channel, ok := DM_CHANNELS[user]; ok {
+		return channel, nil
+	}
+	channel, err := CHAT.DM(user)
+	if err != nil {
+		return "", err
+	}
+	DM_CHANNELS[user] = channel
+	return channel, nil
+}
+
+func allocWithBoth(incoming *Message, outgoing *Message) InternalMessage {
 	return InternalMessage{incoming, outgoing}
 }
 
-func allocWithOutgoing(outgoing *slack.OutgoingMessage) InternalMessage {
-	return allocWithBoth(new(slack.MessageEvent), outgoing)
+func allocWithOutgoing(outgoing *Message) InternalMessage {
+	return allocWithBoth(new(Message), outgoing)
 }
 
-func allocWithIncoming(incoming *slack.MessageEvent) InternalMessage {
-	outgoing := new(slack.OutgoingMessage)
-	outgoing.Id = int(time.Now().UnixNano())
+func allocWithIncoming(incoming *Message) InternalMessage {
+	outgoing := new(Message)
 	outgoing.ChannelId = incoming.ChannelId
-	outgoing.Type = incoming.Type
+	outgoing.ReplyTo = incoming.ReplyTo
+	outgoing.ThreadId = incoming.ThreadId
 
 	return allocWithBoth(incoming, outgoing)
 }
@@ -92,8 +164,20 @@ var TEAM string
 var KEY string
 var CFGFILE string
 var QTEFILE string
+var SUBFILE string
+var REMFILE string
+var LOGDIR string
+var LOGFILE *rotatingFile
+var HTTPADDR string
+var CHECKCONFIG bool
+var CONSOLE_USER string
+var CONSOLE_DM bool
+var FAKE_CALENDAR string
+var PROBE bool
 var TIMEZONE *time.Location
+var timezone_name = "America/Detroit"
 var QUOTES []string
+var QUOTES_LOCK sync.Mutex
 
 func setupAPIClient(keyfile, authURL string) (*http.Client, error) {
 	var data []byte
@@ -102,81 +186,14 @@ func setupAPIClient(keyfile, authURL string) (*http.Client, error) {
 
 	data, err = ioutil.ReadFile(keyfile)
 	if err != nil {
-		conf, _ = google.JWTConfigFromJSON(data, authURL)
-	} else {
-		conf, err = google.JWTConfigFromJSON(data, authURL)
-	}
-
-	return conf.Client(oauth2.NoContext), err
-}
-
-func call(client *http.Client, method string, args map[string]string, log chan string) ([]byte, error) {
-	if method[len(method)-1] != '?' {
-		method += "?"
-	}
-	for k, v := range args {
-		if strings.Contains(method, k) {
-			method = strings.Replace(method, "{"+k+"}", v, -1)
-		} else {
-			method += k + "=" + v + "&"
-		}
+		return nil, err
 	}
-
-	log <- "CALL: Calling method: " + method
-	response, err := client.Get("https://www.googleapis.com/calendar/v3" + method)
-
-	log <- fmt.Sprintf("CALL: Got Response, len: %d", response.ContentLength)
+	conf, err = google.JWTConfigFromJSON(data, authURL)
 	if err != nil {
 		return nil, err
 	}
 
-	log <- "CALL: Moving Response to buffer"
-	json := make([]byte, response.ContentLength)
-	buffer := make([]byte, response.ContentLength)
-	running_length := 0
-	for int64(running_length) < response.ContentLength {
-		length, err := response.Body.Read(buffer)
-		for i := 0; i < length; i++ {
-			json[running_length+i] = buffer[i]
-		}
-		running_length += length
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return nil, err
-		}
-	}
-	return json, nil
-}
-
-func receiver(chReceiver chan slack.SlackEvent, chMessage chan InternalMessage, log chan string) {
-	for {
-		msg, ok := <-chReceiver
-		if !ok {
-			return
-		}
-		switch msg.Data.(type) {
-		case slack.HelloEvent:
-			//Ignore Hello, might want a DM to me
-		case *slack.MessageEvent:
-			a := allocWithIncoming(msg.Data.(*slack.MessageEvent))
-			chMessage <- a
-		//case *slack.PresenceChangeEvent:
-		//	a := msg.Data.(*slack.PresenceChangeEvent)
-		case slack.LatencyReport:
-			a := msg.Data.(slack.LatencyReport)
-
-			log <- fmt.Sprintf("RECEIVER: Current Latency Report: %v", a.Value)
-		case *slack.SlackWSError:
-			error := msg.Data.(*slack.SlackWSError)
-
-			log <- fmt.Sprintf("RECEIVER: Slack Error Message: %d - %s", error.Code, error.Msg)
-		default:
-
-			log <- fmt.Sprintf("RECEIVER: Unexpected / Don't Care: %+v", msg.Data)
-		}
-	}
+	return conf.Client(oauth2.NoContext), nil
 }
 
 func get_Season_From_Month(month time.Month) int {
@@ -298,6 +315,7 @@ func getRange(rng string) (time.Time, time.Time, error) {
 	kulang, _ := regexp.Compile("(?i)((?:[a-zA-Z]+ ?(?:\\d\\d){1,2}?)?) ?w(?:ee)?k ?(\\d{1,2}) ?([a-z]+)?")
 	season_year, _ := regexp.Compile("(?i)((Spring)|(Summer)|(Fall)|(Autumn)|(Winter)) ?(\\d*)?")
 	wkday, _ := regexp.Compile("(?i)((Sun)|(Mon)|(Tues?)|(Wed(?:nes)?)|(Thur?s?)|(Fri)|(Sat)|(Sun))(?:day)?")
+	only_wkday, _ := regexp.Compile("(?i)^ *((Sun)|(Mon)|(Tues?)|(Wed(?:nes)?)|(Thur?s?)|(Fri)|(Sat))(?:day)? *$")
 
 	now := time.Now()
 	startTime := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, TIMEZONE)
@@ -351,6 +369,13 @@ func getRange(rng string) (time.Time, time.Time, error) {
 		} else {
 			endTime = startTime.AddDate(0, 0, 7)
 		}
+	} else if only_wkday.MatchString(rng) {
+		day, err := get_Wkday(strings.ToLower(strings.TrimSpace(rng)))
+		if err != nil {
+			return startTime, endTime, err
+		}
+		startTime = startTime.AddDate(0, 0, (int(day)-int(startTime.Weekday())+7)%7)
+		endTime = startTime.AddDate(0, 0, 1)
 	} else if len(strings.Trim(rng, " ")) > 0 {
 		return startTime, endTime, dateParseError{input: rng, reason: "Invalid Date Format"}
 	}
@@ -429,8 +454,9 @@ func format_calendar_event(response map[string]interface{}) string {
 
 	reply := "``` Start        | End          | Event"
 	reply += strings.Repeat(" ", Max(max_lens[2]-4, 1))
+	loc_fmt := ""
 	if max_lens[3] > 0 {
-		fmt_string = fmt.Sprintf(" | %%-%ds", max_lens[3])
+		loc_fmt = fmt.Sprintf(" | %%-%ds", max_lens[3])
 		reply += "| Location"
 	}
 	reply += "\n" + strings.Repeat("-", len(reply)-3) + "\n"
@@ -438,7 +464,7 @@ func format_calendar_event(response map[string]interface{}) string {
 	for _, row := range table {
 		reply += fmt.Sprintf(fmt_string, row[0], row[1], row[2])
 		if max_lens[3] > 0 {
-			reply += fmt.Sprintf(fmt_string, row[3])
+			reply += fmt.Sprintf(loc_fmt, row[3])
 		}
 		reply += "\n"
 	}
@@ -452,19 +478,187 @@ func Max(a, b int) int {
 	return a
 }
 
-func process(chMessage chan InternalMessage, chSender chan InternalMessage, gApi *http.Client, log chan string) {
+var fully_defined = regexp.MustCompile("(.+) ((to)|(->)) (.+)")
+
+// format_calendar_blocks lays events out a day at a time for chats that can
+// show more than a code block: each title links to the event in Google
+// Calendar, with its time and location underneath.
+func format_calendar_blocks(response map[string]interface{}) []Block {
+	type dayEvent struct {
+		event      map[string]interface{}
+		start, end time.Time
+		all_day    bool
+	}
+	items, _ := response["items"].([]interface{})
+	var events []dayEvent
+	for _, v := range items {
+		event, ok := v.(map[string]interface{})
+		if !ok || event["status"] == "cancelled" || event["summary"] == nil {
+			continue
+		}
+		start_info, _ := event["start"].(map[string]interface{})
+		end_info, _ := event["end"].(map[string]interface{})
+		start, _ := get_date_from_google_shit(start_info)
+		end, _ := get_date_from_google_shit(end_info)
+
+		// All day events are dates, which start at midnight wherever we are.
+		_, all_day := start_info["date"]
+		if all_day {
+			start = time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, TIMEZONE)
+		} else {
+			start, end = start.In(TIMEZONE), end.In(TIMEZONE)
+		}
+		events = append(events, dayEvent{event, start, end, all_day})
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].start.Before(events[j].start)
+	})
+
+	var blocks []Block
+	for _, e := range events {
+		event, start := e.event, e.start
+		when := "All day"
+		if !e.all_day {
+			when = start.Format("3:04pm") + " – " + e.end.Format("3:04pm")
+		}
+		if location, _ := event["location"].(string); location != "" {
+			when += " · " + slack_escape(location)
+		}
+
+		title := slack_escape(event["summary"].(string))
+		if link, _ := event["htmlLink"].(string); link != "" {
+			title = "<" + link + "|" + title + ">"
+		}
+
+		heading := start.Format("Monday, January 2")
+		if len(blocks) == 0 || blocks[len(blocks)-1].Heading != heading {
+			blocks = append(blocks, Block{Heading: heading})
+		}
+		day := &blocks[len(blocks)-1]
+		day.Lines = append(day.Lines, "*"+title+"*\n"+when)
+	}
+	return blocks
+}
+
+// events_reply answers ^events. args is a date range such as "next week" or
+// "monday to friday", optionally naming one of the profile's calendars, and
+// --plain or --rich to override the profile's Events-Format. The blocks are
+// only there for a rich reply. If the range or the calendar call is no good,
+// the text says so and the error is returned too.
+func events_reply(ctx context.Context, gApi *http.Client, args, user string) (string, []Block, error) {
+	log := logger("PROCESS")
+	var err error
+	var startTime, endTime time.Time
+
+	mention := ""
+	if user != "" {
+		mention = fmt.Sprintf(", <@%s>", user)
+	}
+
+	// If both --plain and --rich are given, the last one wins.
+	rich := strings.ToLower(profile().Events_Format) == "rich"
+	if strings.Contains(args, "--") {
+		var words []string
+		for _, word := range strings.Fields(args) {
+			switch word {
+			case "--plain":
+				rich = false
+			case "--rich":
+				rich = true
+			default:
+				words = append(words, word)
+			}
+		}
+		args = strings.Join(words, " ")
+	}
+
+	all_calendars := strings.Contains(args, "all")
+	cal_id := profile().Default_Calendar
+
+	if !all_calendars {
+		for i, cal_name := range profile().Calendar_Name {
+			if strings.Contains(args, strings.ToLower(cal_name)) && i < len(profile().Calendar) {
+				cal_id = profile().Calendar[i]
+				args = strings.Replace(args, cal_name, "", -1)
+				break
+			}
+		}
+	}
+
+	if fully_defined.MatchString(args) {
+		res := fully_defined.FindStringSubmatch(args)
+		startTime, _, err = getRange(res[1])
+		if err != nil {
+			return fmt.Sprintf("'%s' isn't a date%s. Reason: %s", res[1], mention, err), nil, fmt.Errorf("'%s' isn't a date: %s", res[1], err)
+		}
+
+		if res[2] == "to" {
+			endTime, _, err = getRange(res[5])
+		} else {
+			_, endTime, err = getRange(res[5])
+		}
+		if err != nil {
+			return fmt.Sprintf("'%s' isn't a date%s. Reason: %s", res[5], mention, err), nil, fmt.Errorf("'%s' isn't a date: %s", res[5], err)
+		}
+	} else {
+		startTime, endTime, err = getRange(args)
+		if err != nil {
+			return fmt.Sprintf("'%s' isn't a date%s. Reason: %s", args, mention, err), nil, fmt.Errorf("'%s' isn't a date: %s", args, err)
+		}
+	}
+
+	request := calendar_request("/calendars/{calendarId}/events").
+		Param("calendarId", cal_id).
+		Set("timeMin", startTime.Format(time.RFC3339)).
+		Set("timeMax", endTime.Format(time.RFC3339))
+	resp, err := call(ctx, gApi, request)
+	if err != nil {
+		log.Error("Error calling the Calendar API", "error", err)
+		return user_error(err), nil, err
+	}
+	var response map[string]interface{}
+	if err := json.Unmarshal(resp, &response); err != nil {
+		log.Error("Error converting response to JSON", "error", err)
+		return "Sorry, the calendar sent back something I didn't understand.", nil, err
+	}
+
+	if items, _ := response["items"].([]interface{}); len(items) == 0 {
+		return "There are no calendar events scheduled for that week.", nil, nil
+	}
+	if resp := format_calendar_event(response); resp != "" {
+		if rich {
+			return resp, format_calendar_blocks(response), nil
+		}
+		return resp, nil, nil
+	}
+	return "There are no calendar events scheduled for that week.", nil, nil
+}
+
+func process(ctx context.Context, chIncoming chan Message, chSender chan InternalMessage, gApi *http.Client) {
+	log := logger("PROCESS")
 	rx, _ := regexp.Compile("^\\^(\\w+)\\s?(.+)?$")
-	fully_defined, _ := regexp.Compile("(.+) ((to)|(->)) (.+)")
 
 	for {
-		msg := <-chMessage
+		var msg InternalMessage
+		select {
+		case <-ctx.Done():
+			return
+		case incoming := <-chIncoming:
+			msg = allocWithIncoming(&incoming)
+		}
 		if msg.Text == "（╯°□°）╯︵(\\ .o.)\\" {
 			msg.Outgoing.Text = "ಠ_ಠ"
 			chSender <- msg
 			continue
 		}
+		// In a direct message everything is meant for the bot, so the ^ is
+		// optional.
+		if msg.Direct && !strings.HasPrefix(msg.Text, "^") {
+			msg.Text = "^" + msg.Text
+		}
 		for _, v := range rx.FindAllStringSubmatch(msg.Text, -1) {
-			switch strings.ToLower(v[1]) {
+			command := strings.ToLower(v[1])
+			switch command {
 			case "hello":
 				msg.Outgoing.Text = "Hello, world!"
 				chSender <- msg
@@ -472,262 +666,310 @@ func process(chMessage chan InternalMessage, chSender chan InternalMessage, gApi
 				msg.Outgoing.Text = "Hype!"
 				chSender <- msg
 			case "events":
-				args := make(map[string]string)
-				var err error
-				var startTime, endTime time.Time
-
-				all_calendars := strings.Contains(v[2], "all")
-				cal_id := CONFIG.Profile[TEAM].Default_Calendar
-
-				if !all_calendars {
-					for i, cal_name := range CONFIG.Profile[TEAM].Calendar_Name {
-						if strings.Contains(v[2], strings.ToLower(cal_name)) {
-							cal_id = CONFIG.Profile[TEAM].Calendar[i]
-							v[2] = strings.Replace(v[2], cal_name, "", -1)
-							break
-						}
-					}
+				msg.Outgoing.Text, msg.Outgoing.Blocks, _ = events_reply(ctx, gApi, v[2], msg.UserId)
+				if lines := strings.Count(msg.Outgoing.Text, "\n") + 1; msg.ThreadId == "" && !msg.Direct &&
+					profile().Thread_Events > 0 && lines > profile().Thread_Events {
+					msg.Outgoing.ThreadId = msg.Id
 				}
+				chSender <- msg
+			case "restart":
+				// Only the first admin can restart the bot.
+				if admins := profile().Admin; len(admins) > 0 && msg.UserId == admins[0] {
+					msg.Outgoing.Text = quote()
+					chSender <- msg
 
-				if fully_defined.MatchString(v[2]) {
-					res := fully_defined.FindStringSubmatch(v[2])
-					startTime, _, err = getRange(res[1])
-					if err != nil {
-						msg.Outgoing.Text = fmt.Sprintf("'%s' isn't a date, <@%s>. Reason: %s", res[1], msg.UserId, err)
-						chSender <- msg
-					}
-
-					if res[2] == "to" {
-						endTime, _, err = getRange(res[3])
-					} else {
-						_, endTime, err = getRange(res[3])
-					}
-
-					if err != nil {
-						msg.Outgoing.Text = fmt.Sprintf("'%s' isn't a date, <@%s>. Reason: %s", res[2], msg.UserId, err)
-						chSender <- msg
-					}
-				} else {
-					startTime, endTime, err = getRange(v[2])
-					if err != nil {
-						msg.Outgoing.Text = fmt.Sprintf("'%s' isn't a date, <@%s>. Reason: %s", v[2], msg.UserId, err)
-						chSender <- msg
-					}
+					log.Info("Restart requested", "user", msg.UserId)
+					COMMANDS_PROCESSED.Inc(command)
+					shutdown(true)
+					return
 				}
-
-				if err == nil {
-					args["calendarId"] = cal_id
-					args["timeMin"] = startTime.Format(time.RFC3339)
-					args["timeMax"] = endTime.Format(time.RFC3339)
-					resp, err := call(gApi, "/calendars/{calendarId}/events", args, log)
-					if err != nil {
-
-						log <- "PROCESS: Error at process: " + err.Error()
-					}
-					var response map[string]interface{}
-					if err := json.Unmarshal(resp, &response); err != nil {
-
-						log <- "PROCESS: Error at process: " + err.Error()
-						panic(err)
-					}
-
-					if len(response["items"].([]interface{})) == 0 {
-						msg.Outgoing.Text = "There are no calendar events scheduled for that week."
-						chSender <- msg
-					} else {
-						resp := format_calendar_event(response)
-						if resp == "" {
-							msg.Outgoing.Text = "There are no calendar events scheduled for that week."
-						} else {
-							msg.Outgoing.Text = resp
-						}
-						chSender <- msg
-					}
+			case "subscribe":
+				msg.Outgoing.Text = subscribe(msg.UserId, v[2])
+				chSender <- msg
+			case "unsubscribe":
+				msg.Outgoing.Text = unsubscribe(msg.UserId, v[2])
+				chSender <- msg
+			case "remind":
+				channel := msg.ChannelId
+				if msg.Direct {
+					// "here" in a DM is the same as "me".
+					channel = ""
 				}
-			case "restart":
-				if msg.UserId == CONFIG.Profile[TEAM].Admin[0] {
-					quote := quote()
-					msg.Outgoing.Text = quote
-					chSender <- msg
-					time.Sleep(time.Second)
-					panic(quote)
+				msg.Outgoing.Text = remind(msg.UserId, channel, v[2])
+				chSender <- msg
+			case "reminders":
+				msg.Outgoing.Text = reminders(msg.UserId, v[2])
+				chSender <- msg
+			case "reload":
+				if !is_admin(msg.UserId) {
+					msg.Outgoing.Text = "Only admins can do that."
+				} else if err := request_reload(ctx, "^reload"); err != nil {
+					msg.Outgoing.Text = "I couldn't reload, so I'm keeping the old config:\n" + err.Error()
+				} else {
+					msg.Outgoing.Text = "Reloaded the config and quotes."
 				}
+				chSender <- msg
+			case "status":
+				msg.Outgoing.Text = status_command(msg.UserId)
+				chSender <- msg
+			case "uptime":
+				msg.Outgoing.Text = uptime_command(msg.UserId)
+				chSender <- msg
 			case "psycho": fallthrough
 			case "quote":
 				msg.Outgoing.Text = quote()
 				chSender <- msg
 			default:
+				command = "unknown"
 				msg.Outgoing.Text = fmt.Sprintf("I don't understand what you said, <@%s>", msg.UserId)
 				chSender <- msg
 			}
+			COMMANDS_PROCESSED.Inc(command)
 		}
 	}
 }
 
-func update_every_morning(gApi *http.Client, chSender chan InternalMessage, log chan string) {
-	args := make(map[string]string)
-	args["calendarId"] = CONFIG.Profile[TEAM].Default_Calendar
+func update_every_morning(ctx context.Context, gApi *http.Client, chSender chan InternalMessage) {
+	log := logger("MORNING_UPDATE")
 	var next_morning time.Time
 
 	for {
-		t := time.Now().Local()
+		t := time.Now().In(TIMEZONE)
 		if t.Hour() < 7 {
 			next_morning = time.Date(t.Year(), t.Month(), t.Day(), 7, 0, 0, 0, TIMEZONE)
 		} else {
 			next_morning = time.Date(t.Year(), t.Month(), t.Day()+1, 7, 0, 0, 0, TIMEZONE)
 		}
-		day := time.Date(next_morning.Year(), next_morning.Month(), next_morning.Day(), 0, 0, 0, 0, TIMEZONE)
-		args["timeMin"] = day.Format(time.RFC3339)
-		args["timeMax"] = day.AddDate(0, 0, 1).Format(time.RFC3339)
+		if !sleep(ctx, next_morning.Sub(t)) {
+			return
+		}
 
-		post := "Good Morning!\n"
 		msg := allocInternalMessage()
-
-		log <- fmt.Sprintf("MORNING_UPDATE: Making Request:\t%+v", args)
-		resp, err := call(gApi, "/calendars/{calendarId}/events", args, log)
-		if err != nil {
-
-			log <- "PMORNING_UPDATE: Error making Calendar Request: " + err.Error()
-			panic(err)
+		text, _ := morning_message(ctx, gApi, next_morning, 5)
+		if ctx.Err() != nil {
+			return
 		}
+		msg.Outgoing.Text = text
 
-		log <- "MORNING_UPDATE: Successfully Requested Calendar Events"
+		if held := take_digest(); len(held) > 0 {
+			msg.Outgoing.Text += "\nWhile you were away:\n" + strings.Join(held, "\n")
+		}
 
-		var response map[string]interface{}
+		log.Info("Posting morning message")
+		chSender <- msg
+		record_digest()
+	}
+}
 
-		log <- "MORNING_UPDATE: Converting Request to JSON"
-		err = json.Unmarshal(resp, &response)
+// morning_message lists the default calendar's events on day, trying the
+// Calendar API up to attempts times. It gives up early if ctx is cancelled.
+// If the calendar can't be read, the text says so and the error is returned
+// too.
+func morning_message(ctx context.Context, gApi *http.Client, day time.Time, attempts int) (string, error) {
+	log := logger("MORNING_UPDATE")
+	day = time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, TIMEZONE)
+	request := calendar_request("/calendars/{calendarId}/events").
+		Param("calendarId", profile().Default_Calendar).
+		Set("timeMin", day.Format(time.RFC3339)).
+		Set("timeMax", day.AddDate(0, 0, 1).Format(time.RFC3339))
+
+	post := "Good Morning!\n"
+
+	var response map[string]interface{}
+	var err error
+	for attempt := 1; response == nil && attempt <= attempts; attempt++ {
+		log.Debug("Making request", "request", request)
+		var resp []byte
+		resp, err = call(ctx, gApi, request)
+		if err == nil {
+			err = json.Unmarshal(resp, &response)
+		}
 		if err != nil {
 
-			log <- "MORNING_UPDATE: Error converting response to JSON: " + err.Error()
-			panic(err)
+			log.Error("Error getting calendar events", "attempt", attempt, "error", err)
+			response = nil
+			if attempt < attempts && !sleep(ctx, time.Duration(attempt)*time.Minute) {
+				return "", ctx.Err()
+			}
 		}
+	}
 
-		log <- "MORNING_UPDATE: Successfully converted response to JSON"
-
-		if len(response["items"].([]interface{})) == 0 {
-			msg.Outgoing.Text = post + "There are no events happening today."
-		} else {
-			msg.Outgoing.Text = post + "Here are the events happening today:\n" + format_calendar_event(response)
-		}
+	if err != nil {
+		return post + "I couldn't get today's events from the calendar.", err
+	}
+	if items, ok := response["items"].([]interface{}); !ok {
+		return post + "I couldn't get today's events from the calendar.", errors.New("no events in the calendar's response")
+	} else if len(items) == 0 {
+		return post + "There are no events happening today.", nil
+	}
+	return post + "Here are the events happening today:\n" + format_calendar_event(response), nil
+}
 
-		time.Sleep(next_morning.Sub(t))
+// REPLAN wakes recurring_notifier so it can rebuild today's notifications,
+// e.g. after someone subscribes to reminders.
+var REPLAN = make(chan bool, 1)
 
-		log <- "MORNING_UPDATE: Posting Morning Message"
-		chSender <- msg
+func replan_notifications() {
+	select {
+	case REPLAN <- true:
+	default:
 	}
 }
 
-func recurring_notifier(gApi *http.Client, chSender chan InternalMessage, log chan string) {
-	args := make(map[string]string)
-	args["calendarId"] = CONFIG.Profile[TEAM].Default_Calendar
+func recurring_notifier(ctx context.Context, gApi *http.Client, chSender chan InternalMessage) {
+	log := logger("NOTIFIER")
 	var next_morning time.Time
 	var midnight time.Time
+	var timers []*time.Timer
+	var scheduled []scheduledNotification
+
+	// Only reminders due before the next plan are scheduled; later ones are
+	// left for it.
+	schedule := func(event map[string]interface{}, start time.Time, before time.Duration, user string, chSender chan InternalMessage) {
+		if !start.Add(-before).Before(next_morning) {
+			return
+		}
+		if timer := wait_to_notify(event, start, before, user, chSender); timer != nil {
+			timers = append(timers, timer)
+			REMINDER_COUNT.Inc("event", "scheduled")
+			scheduled = append(scheduled, scheduledNotification{Fire: start.Add(-before), Summary: event["summary"].(string), User: user})
+		}
+	}
 
 	for {
 		t := time.Now().In(TIMEZONE)
 		midnight = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, TIMEZONE)
 		next_morning = midnight.AddDate(0, 0, 1)
 
-		args["timeMin"] = midnight.Format(time.RFC3339)
-		args["timeMax"] = next_morning.Format(time.RFC3339)
-
-		log <- fmt.Sprintf("NOTIFIER: Making Request:\t%+v", args)
-		resp, err := call(gApi, "/calendars/{calendarId}/events", args, log)
-		if err != nil {
-
-			log <- "NOTIFIER: Error making Calendar Request: " + err.Error()
-			continue
+		for _, timer := range timers {
+			if timer.Stop() {
+				REMINDER_COUNT.Inc("event", "cancelled")
+			}
 		}
+		timers = nil
+		scheduled = nil
+
+		// A reminder due today can be for an event days away, e.g. ^subscribe
+		// with 1d.
+		until := next_morning.Add(longest_offset())
+		for _, calendarId := range subscribed_calendars() {
+			request := calendar_request("/calendars/{calendarId}/events").
+				Param("calendarId", calendarId).
+				Set("timeMin", midnight.Format(time.RFC3339)).
+				Set("timeMax", until.Format(time.RFC3339)).
+				Set("singleEvents", "true")
+
+			log.Debug("Making request", "request", request)
+			resp, err := call(ctx, gApi, request)
+			if err != nil {
 
-		var response map[string]interface{}
-
-		log <- "NOTIFIER: Converting response to JSON"
-		if err := json.Unmarshal(resp, &response); err != nil {
+				log.Error("Error making calendar request", "calendar", calendarId, "error", err)
+				continue
+			}
 
-			log <- "NOTIFIER: Error converting response to JSON: " + err.Error()
-			continue
-		}
+			var response map[string]interface{}
 
-		log <- "NOTIFIER: Successfully converted response to JSON"
+			if err := json.Unmarshal(resp, &response); err != nil {
 
-		for _, entry := range response["items"].([]interface{}) {
-			event := entry.(map[string]interface{})
-			if event["summary"] == nil {
+				log.Error("Error converting response to JSON", "calendar", calendarId, "error", err)
 				continue
 			}
-			for k, v := range event["start"].(map[string]interface{}) {
-				switch k {
-				case "dateTime":
 
-					log <- "NOTIFIER: Found non-All-Day event, parsing time."
-					start, err := time.Parse(time.RFC3339, v.(string))
-					if err != nil {
+			items, _ := response["items"].([]interface{})
+			for _, entry := range items {
+				event := entry.(map[string]interface{})
+				if event["summary"] == nil {
+					continue
+				}
+				for k, v := range event["start"].(map[string]interface{}) {
+					switch k {
+					case "dateTime":
 
-						log <- "NOTIFIER: Error parsing date from google: " + v.(string)
-						continue
-					}
+						start, err := time.Parse(time.RFC3339, v.(string))
+						if err != nil {
 
-					log <- "NOTIFIER: Successfully parsed time. Setting up notifiers"
-					if start.Sub(t) > 0 {
-						go wait_to_notify(event, start, time.Hour, chSender)
-						go wait_to_notify(event, start, time.Minute*10, chSender)
+							log.Warn("Error parsing date from google", "date", v.(string))
+							continue
+						}
+
+						log.Debug("Setting up notifiers", "event", event["summary"], "start", start)
+						if calendarId == profile().Default_Calendar {
+							schedule(event, start, time.Hour, "", chSender)
+							schedule(event, start, time.Minute*10, "", chSender)
+						}
+						for user, offsets := range subscribers_for(calendarId, event["summary"].(string)) {
+							for _, before := range offsets {
+								schedule(event, start, before, user, chSender)
+							}
+						}
 					}
 				}
 			}
 		}
-		time.Sleep(next_morning.Sub(time.Now().In(TIMEZONE)))
+		set_scheduled_notifications(scheduled)
+
+		select {
+		case <-ctx.Done():
+			for _, timer := range timers {
+				if timer.Stop() {
+					REMINDER_COUNT.Inc("event", "cancelled")
+				}
+			}
+			return
+		case <-time.After(next_morning.Sub(time.Now().In(TIMEZONE))):
+		case <-REPLAN:
+			log.Info("Replanning today's notifications")
+		}
 	}
 }
 
-func wait_to_notify(event map[string]interface{}, start time.Time, before time.Duration, chSender chan InternalMessage) {
-	msg := allocInternalMessage()
-	msg.Outgoing.Text = fmt.Sprintf("Hey Guys! Dont forget, %s is coming up in %v!:\n", event["summary"].(string), before)
-
-	time.Sleep(start.Add(before * -1).Sub(time.Now().In(TIMEZONE)))
-	chSender <- msg
+// wait_to_notify schedules a reminder for event, posted to the default channel
+// or, if user is set, sent to them as a direct message. It returns nil if the
+// reminder would already have gone out.
+func wait_to_notify(event map[string]interface{}, start time.Time, before time.Duration, user string, chSender chan InternalMessage) *time.Timer {
+	wait := start.Add(before * -1).Sub(time.Now().In(TIMEZONE))
+	if wait < 0 {
+		return nil
+	}
+	return time.AfterFunc(wait, func() {
+		REMINDER_COUNT.Inc("event", "fired")
+		msg := allocInternalMessage()
+		if user == "" {
+			msg.Outgoing.Text = format_channel_reminder(event, start, before)
+		} else {
+			channel, err := dm_channel(user)
+			if err != nil {
+				logger("NOTIFIER").Error("Error opening DM", "user", user, "error", err)
+				return
+			}
+			msg.Outgoing.ChannelId = channel
+			msg.Outgoing.Text = format_dm_reminder(event, start, before, user)
+		}
+		notify(NOTIFY_EVENT, msg, chSender)
+	})
 }
 
-func log(fname *os.File, incoming chan string) {
-	var log string
-
-	for {
-		writer := bufio.NewWriter(fname)
-		log = <-incoming
-		line := "[" + time.Now().Format(time.RFC3339) + "]:\t" + log
-
-		cmd := exec.Command("echo",  line)
-		stdoutPipe, err := cmd.StdoutPipe()
-    if err != nil {
-        fmt.Println(err)
-				continue
-    }
-
-    err = cmd.Start()
-    if err != nil {
-        fmt.Println(err)
-				continue
-    }
-
-    go io.Copy(writer, stdoutPipe)
-    cmd.Wait()
-		writer.Flush()
+func prep_quotes() error {
+	quotes, err := load_quotes(QTEFILE)
+	if err != nil {
+		return err
 	}
+	QUOTES_LOCK.Lock()
+	QUOTES = quotes
+	QUOTES_LOCK.Unlock()
+	return nil
 }
 
-func prep_quotes() {
-	stats, err := os.Stat(QTEFILE)
+func load_quotes(file string) ([]string, error) {
+	stats, err := os.Stat(file)
 	if err != nil {
-		fmt.Println("Failed to load quotes:")
-		fmt.Println(err)
-		panic(err)
+		return nil, err
 	}
-	quotefile, err := os.OpenFile(QTEFILE, os.O_RDONLY, 0666)
+	quotefile, err := os.OpenFile(file, os.O_RDONLY, 0666)
 	if err != nil {
-		fmt.Println("Failed to load quotes:")
-		fmt.Println(err)
-		panic(err)
+		return nil, err
 	}
+	defer quotefile.Close()
 
 	qtes := make([]byte, stats.Size())
 	buffer := make([]byte, stats.Size())
@@ -742,104 +984,162 @@ func prep_quotes() {
 			break
 		}
 		if err != nil {
-			fmt.Println("Failed to load quotes:")
-			fmt.Println(err)
-			panic(err)
+			return nil, err
 		}
 	}
 
-	QUOTES = strings.Split(string(qtes[:stats.Size()]), "\n")
-	quotefile.Close()
+	return strings.Split(string(qtes[:stats.Size()]), "\n"), nil
 }
 
 func quote() string {
+	QUOTES_LOCK.Lock()
+	defer QUOTES_LOCK.Unlock()
+
+	if len(QUOTES) == 0 {
+		return "..."
+	}
 	val, err := rand.Int(rand.Reader, big.NewInt(int64(len(QUOTES))))
 	if err != nil {
-		fmt.Println("Failed to get random value:\n", err)
-		panic(err)
+		return QUOTES[0]
 	}
 	return QUOTES[val.Int64()]
 }
 
 func init() {
-	flag.StringVar(&KEY, "key", "key.json", "Calendar Api Key")
-	flag.StringVar(&KEY, "k", "key.json", "Calendar Api Key (shorthand)")
+	flag.StringVar(&KEY, "key", env_default("CALBOT_KEY", "key.json"), "Calendar Api Key (or set CALBOT_KEY)")
+	flag.StringVar(&KEY, "k", env_default("CALBOT_KEY", "key.json"), "Calendar Api Key (shorthand)")
 	flag.StringVar(&CFGFILE, "config", "config.gcfg", "Config File Name")
 	flag.StringVar(&CFGFILE, "c", "config.gcfg", "Config File Name (shorthand)")
 	flag.StringVar(&QTEFILE, "quote", "quote.txt", "Quote File Name")
 	flag.StringVar(&QTEFILE, "q", "quote.txt", "Quote File Name (shorthand)")
+	flag.StringVar(&SUBFILE, "subscriptions", "subscriptions.json", "Reminder Subscriptions File Name")
+	flag.StringVar(&SUBFILE, "s", "subscriptions.json", "Reminder Subscriptions File Name (shorthand)")
+	flag.StringVar(&REMFILE, "reminders", "reminders.json", "Reminders File Name")
+	flag.StringVar(&REMFILE, "r", "reminders.json", "Reminders File Name (shorthand)")
+	flag.StringVar(&LOGDIR, "log-dir", "log", "Log Directory")
+	flag.StringVar(&HTTPADDR, "http", "", "Address to serve /healthz, /readyz, /status and /metrics on, e.g. :8080 (disabled if empty)")
+	flag.BoolVar(&CHECKCONFIG, "check-config", false, "Check the config and key files, report any problems and exit")
+	flag.BoolVar(&PROBE, "probe-calendars", false, "Also check that every configured calendar can be read")
+	flag.StringVar(&CONSOLE_USER, "as", "UCONSOLE", "User id to send console commands as")
+	flag.BoolVar(&CONSOLE_DM, "dm", false, "Send console commands as direct messages to the bot")
+	flag.StringVar(&FAKE_CALENDAR, "fake-calendar", "", "JSON file of events to serve instead of the Calendar API in console mode")
+	flag.DurationVar(&READY_WITHIN, "ready-within", 5*time.Minute, "Report not ready if no Calendar call has succeeded for this long")
 }
 
-func main() {
-	flag.Parse()
-	for i, arg := range os.Args[1:] {
-		if os.Args[i][0] != '-' || strings.Contains(os.Args[i], "=") || arg[0] != '-' {
-			TEAM = arg
-			break
-		}
-	}
-
-	prep_quotes()
-
+// run_bot connects to the chat platform and runs until shut down.
+func run_bot() {
 	chSender := make(chan InternalMessage, 10)
-	chReceiver := make(chan slack.SlackEvent, 10)
-	chMessage := make(chan InternalMessage, 10)
-	fname := time.Now().Format(time.RFC3339)
+	chIncoming := make(chan Message, 10)
 
-	logFile, err := os.Create("log/" + fname + ".log")
+	var err error
+	LOGFILE, err = open_log_dir(LOGDIR, TEAM)
 	if err != nil {
 		fmt.Println("STARTUP: Error at creating START logfile:\t" + err.Error())
-		panic(err)
+		os.Exit(1)
+	}
+	configure_logging(LOGFILE, "", "", nil)
+	log := logger("STARTUP")
+
+	fatal := func(msg string, err error) {
+		fmt.Println(redact("STARTUP: " + msg + ":\t" + err.Error()))
+		log.Error(msg, "error", err)
+		os.Exit(1)
 	}
-	chStart := make(chan string, 10)
-	go log(logFile, chStart)
 
-	err = gcfg.ReadFileInto(&CONFIG, CFGFILE)
+	err = prep_quotes()
+	if err != nil {
+		fatal("Error at loading quotes", err)
+	}
+
+	CONFIG, err = load_config(CFGFILE)
+	if err != nil {
+		fatal("Error at loading config file", err)
+	}
+	if problems := validate_config(&CONFIG, CFGFILE, TEAM, false); len(problems) > 0 {
+		for _, p := range problems {
+			fmt.Println("STARTUP: " + p.String())
+			log.Error("Config problem", "problem", p)
+		}
+		os.Exit(1)
+	}
+	err = apply_log_config(CONFIG)
 	if err != nil {
-		chStart <- "STARTUP: Error at loading config file:\t" + err.Error()
-		panic(err)
+		fatal("Error at configuring logging", err)
 	}
-	chStart <- "STARTUP: Successfully loaded the Config File:\t" + CFGFILE
+	log.Info("Successfully loaded the Config File", "file", CFGFILE)
 
-	TIMEZONE, err = time.LoadLocation("America/Detroit")
+	TIMEZONE, err = time.LoadLocation(timezone_name)
 	if err != nil {
-		chStart <- "STARTUP: Error at loading Timezone:\t" + err.Error()
-		panic(err)
+		fatal("Error at loading Timezone", err)
 	}
 
 	gApi, err := setupAPIClient(KEY, "https://www.googleapis.com/auth/calendar")
 	if err != nil {
-		chStart <- "STARTUP: Error when loading the Calendar API:\t" + err.Error()
-		panic(err)
+		fatal("Error when loading the Calendar API", err)
+	}
+	log.Info("Successfully loaded the Calendar API")
+	if PROBE {
+		if problems := probe_calendars(gApi); len(problems) > 0 {
+			fatal("Error at probing calendars", errors.New(strings.Join(problems, "; ")))
+		}
+		log.Info("Successfully probed the calendars")
 	}
-	chStart <- "STARTUP: Successfully loaded the Calendar API"
 
-	api := slack.New(CONFIG.Profile[TEAM].Slack)
-	api.SetDebug(false)
-	wsAPI, err := api.StartRTM("", "http://localhost/")
+	err = load_subscriptions()
 	if err != nil {
-		chStart <- "STARTUP: Error when starting websocket:\t" + err.Error()
-		panic(err)
+		fatal("Error at loading subscriptions", err)
 	}
-	chStart <- "STARTUP: Successfully opened the websocket"
+	log.Info("Successfully loaded the Subscriptions File", "file", SUBFILE)
 
-	go wsAPI.HandleIncomingEvents(chReceiver)
-	go wsAPI.Keepalive(20 * time.Second)
-	go process(chMessage, chSender, gApi, chStart)
-	go func(wsAPI *slack.SlackWS, outbox chan InternalMessage, log chan string) {
-		for {
-			select {
-			case msg := <-outbox:
+	err = load_reminders()
+	if err != nil {
+		fatal("Error at loading reminders", err)
+	}
+	log.Info("Successfully loaded the Reminders File", "file", REMFILE)
 
-				log <- fmt.Sprintf("OUTBOX: Sending Message: %s\n", msg.Outgoing.Text)
-				wsAPI.SendMessage(msg.Outgoing)
-			}
-		}
-	}(wsAPI, chSender, chStart)
+	CHAT = new_chat_adapter(profile())
+
+	ctx := lifecycle_context()
+	senderDone := make(chan bool)
 
-	go update_every_morning(gApi, chSender, chStart)
-	go recurring_notifier(gApi, chSender, chStart)
-	chStart <- "STARTUP: Successfully loaded all main threads. Starting Receiver"
+	go handle_signals(ctx)
+	if HTTPADDR != "" {
+		go serve_health(ctx, HTTPADDR)
+		go probe_calendar(ctx, gApi)
+	}
+	go process(ctx, chIncoming, chSender, gApi)
+	go sender(ctx, chSender, senderDone)
+
+	go update_every_morning(ctx, gApi, chSender)
+	go recurring_notifier(ctx, gApi, chSender)
+	go reminder_scheduler(ctx, chSender)
+	start_change_watchers(ctx, gApi, chSender)
+	go reloader(ctx, gApi, chSender)
+	go watch_config_files(ctx)
+	log.Info("Successfully loaded all main threads. Starting Receiver")
+
+	CHAT.Run(ctx, chIncoming)
+
+	log = logger("SHUTDOWN")
+	log.Info("Draining outgoing messages")
+	select {
+	case <-senderDone:
+	case <-time.After(10 * time.Second):
+		log.Warn("Gave up waiting for outgoing messages")
+	}
 
-	receiver(chReceiver, chMessage, chStart)
+	restart := restart_requested()
+	if restart {
+		log.Info("Restarting")
+	} else {
+		log.Info("Exiting")
+	}
+	LOGFILE.Close()
+
+	if restart {
+		if err := reexec(); err != nil {
+			fmt.Println("SHUTDOWN: Error restarting:\t" + err.Error())
+			os.Exit(1)
+		}
+	}
 }
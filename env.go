@@ -0,0 +1,203 @@
+package main
+
+import (
+	"code.google.com/p/gcfg"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Every config field can be overridden from the environment, which wins over
+// the config file:
+//
+//	CALBOT_LOG_LEVEL=debug
+//	CALBOT_<PROFILE>_SLACK=xoxb-...
+//	CALBOT_<PROFILE>_CALENDAR=id1,id2
+//
+// <PROFILE> is the profile name in upper case with anything that isn't a
+// letter or digit turned into "_". List fields take comma separated values.
+const env_prefix = "CALBOT_"
+
+var env_name_rx = regexp.MustCompile("[^A-Z0-9]+")
+
+func env_name(parts ...string) string {
+	for i, part := range parts {
+		parts[i] = env_name_rx.ReplaceAllString(strings.ToUpper(part), "_")
+	}
+	return env_prefix + strings.Join(parts, "_")
+}
+
+// env_default returns the value of the environment variable name if it is
+// set, otherwise def, for flags that can also be set from the environment.
+func env_default(name, def string) string {
+	if value, ok := os.LookupEnv(name); ok {
+		return value
+	}
+	return def
+}
+
+// load_config reads the config file, applies environment overrides and then
+// reads any secrets the active profile keeps in separate files. Other
+// profiles' secret files are left alone: they may only exist where that
+// profile runs, and check-config reports them (see check_secret_files).
+func load_config(file string) (ConfigFile, error) {
+	var config ConfigFile
+	if err := gcfg.ReadFileInto(&config, file); err != nil {
+		return config, err
+	}
+	if err := apply_env_overrides(&config); err != nil {
+		return config, err
+	}
+	if err := read_secret_files(&config); err != nil {
+		return config, err
+	}
+	return config, nil
+}
+
+func apply_env_overrides(config *ConfigFile) error {
+	if err := override_fields(reflect.ValueOf(&config.Log).Elem(), "LOG"); err != nil {
+		return err
+	}
+
+	if config.Profile == nil {
+		config.Profile = make(map[string]*Profile)
+	}
+	// The active profile can live entirely in the environment.
+	if _, ok := config.Profile[TEAM]; !ok && TEAM != "" {
+		profile := new(Profile)
+		prefix := env_name(TEAM) + "_"
+		for _, entry := range os.Environ() {
+			if strings.HasPrefix(entry, prefix) {
+				config.Profile[TEAM] = profile
+				break
+			}
+		}
+	}
+
+	for name, profile := range config.Profile {
+		if err := override_fields(reflect.ValueOf(profile).Elem(), name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// override_fields sets each field of section from CALBOT_<prefix>_<FIELD>.
+func override_fields(section reflect.Value, prefix string) error {
+	for i := 0; i < section.NumField(); i++ {
+		field := section.Type().Field(i)
+		name := env_name(prefix, field.Name)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+
+		target := section.Field(i)
+		switch target.Kind() {
+		case reflect.String:
+			target.SetString(value)
+		case reflect.Int:
+			n, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil {
+				return fmt.Errorf("%s: %q isn't a number", name, value)
+			}
+			target.SetInt(int64(n))
+		case reflect.Bool:
+			b, err := strconv.ParseBool(strings.TrimSpace(value))
+			if err != nil {
+				return fmt.Errorf("%s: %q isn't true or false", name, value)
+			}
+			target.SetBool(b)
+		case reflect.Slice:
+			var list []string
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					list = append(list, item)
+				}
+			}
+			target.Set(reflect.ValueOf(list))
+		}
+	}
+	return nil
+}
+
+// secret_fields finds the secrets in a profile: every field X that has an
+// X_File to read it from.
+func secret_fields(profile *Profile) map[string]reflect.Value {
+	section := reflect.ValueOf(profile).Elem()
+	secrets := make(map[string]reflect.Value)
+	for i := 0; i < section.NumField(); i++ {
+		name := section.Type().Field(i).Name
+		if !strings.HasSuffix(name, "_File") {
+			continue
+		}
+		if secret := section.FieldByName(strings.TrimSuffix(name, "_File")); secret.Kind() == reflect.String {
+			secrets[name] = secret
+		}
+	}
+	return secrets
+}
+
+// read_secret_files replaces the active profile's secrets with the contents
+// of their files, e.g. Slack with Slack_File, so tokens can be mounted rather
+// than written into the config.
+func read_secret_files(config *ConfigFile) error {
+	profile, ok := config.Profile[TEAM]
+	if !ok {
+		return nil
+	}
+	section := reflect.ValueOf(profile).Elem()
+	for field, secret := range secret_fields(profile) {
+		file := section.FieldByName(field).String()
+		if file == "" {
+			continue
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("profile %q: reading %s: %s", TEAM, strings.Replace(field, "_", "-", -1), err)
+		}
+		secret.SetString(strings.TrimSpace(string(data)))
+	}
+	return nil
+}
+
+// check_secret_files makes sure every other profile's secret files can be
+// read, without keeping what's in them.
+func check_secret_files(config *ConfigFile) []string {
+	var problems []string
+	for name, profile := range config.Profile {
+		if name == TEAM {
+			continue
+		}
+		section := reflect.ValueOf(profile).Elem()
+		for field := range secret_fields(profile) {
+			file := section.FieldByName(field).String()
+			if file == "" {
+				continue
+			}
+			if _, err := ioutil.ReadFile(file); err != nil {
+				problems = append(problems, fmt.Sprintf("profile %q: reading %s: %s", name, strings.Replace(field, "_", "-", -1), err))
+			}
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+// config_secrets lists the values that must never appear in the log.
+func config_secrets(config ConfigFile) []string {
+	var secrets []string
+	for _, profile := range config.Profile {
+		for _, secret := range secret_fields(profile) {
+			if secret.String() != "" {
+				secrets = append(secrets, secret.String())
+			}
+		}
+	}
+	return secrets
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// serve_fake_calendar answers Calendar API event queries from a JSON file of
+// events in the API's own format, for trying the bot out without a Google
+// account. Every calendar id sees the same events. It returns the base URL to
+// use in place of CALENDAR_API.
+func serve_fake_calendar(file string) (string, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	var events []map[string]interface{}
+	if err := json.Unmarshal(data, &events); err != nil {
+		return "", err
+	}
+	for _, event := range events {
+		for key, value := range map[string]interface{}{"status": "confirmed", "summary": "", "id": ""} {
+			if _, ok := event[key]; !ok {
+				event[key] = value
+			}
+		}
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(parts) < 2 || parts[0] != "calendars" {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if len(parts) == 2 {
+			json.NewEncoder(w).Encode(map[string]interface{}{"id": parts[1], "summary": parts[1]})
+			return
+		}
+
+		min, _ := time.Parse(time.RFC3339, r.URL.Query().Get("timeMin"))
+		max, _ := time.Parse(time.RFC3339, r.URL.Query().Get("timeMax"))
+		items := []interface{}{}
+		for _, event := range events {
+			start, _ := event["start"].(map[string]interface{})
+			end, _ := event["end"].(map[string]interface{})
+			from, _ := get_date_from_google_shit(start)
+			to, _ := get_date_from_google_shit(end)
+			if (max.IsZero() || from.Before(max)) && (min.IsZero() || to.After(min)) {
+				items = append(items, event)
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"items": items})
+	}))
+	return "http://" + listener.Addr().String(), nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// READY_WITHIN is how recently a Calendar call must have succeeded for the
+// bot to report itself ready. probe_calendar makes one every
+// calendar_probe_interval so this doesn't depend on anyone using the bot.
+var READY_WITHIN time.Duration
+
+const (
+	calendar_probe_interval = time.Minute
+	calendar_probe_timeout  = 30 * time.Second
+)
+
+func health_handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if reason := not_ready(); reason != "" {
+			http.Error(w, reason, http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(status_report())
+	})
+
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		write_metrics(w)
+	})
+
+	return mux
+}
+
+// not_ready explains why the bot isn't ready, or returns "" if it is.
+func not_ready() string {
+	if up, _ := chat_status(); !up {
+		return "not connected to chat"
+	}
+
+	STATUS.Lock()
+	defer STATUS.Unlock()
+	if STATUS.calendar_ok.IsZero() {
+		return "no successful calendar call yet"
+	}
+	if READY_WITHIN > 0 && time.Since(STATUS.calendar_ok) > READY_WITHIN {
+		reason := "no successful calendar call since " + STATUS.calendar_ok.Format(time.RFC3339)
+		if STATUS.calendar_error != "" {
+			reason += ": " + STATUS.calendar_error
+		}
+		return reason
+	}
+	return ""
+}
+
+// probe_calendar looks up the default calendar every calendar_probe_interval
+// until ctx is cancelled, so /readyz knows whether the Calendar API still
+// works even when nothing else is calling it. call records the result.
+func probe_calendar(ctx context.Context, gApi *http.Client) {
+	log := logger("HTTP")
+	for {
+		probeCtx, cancel := context.WithTimeout(ctx, calendar_probe_timeout)
+		request := calendar_request("/calendars/{calendarId}").
+			Param("calendarId", CONFIG.Profile[TEAM].Default_Calendar)
+		if _, err := call(probeCtx, gApi, request); err != nil && ctx.Err() == nil {
+			log.Warn("Calendar probe failed", "error", err)
+		}
+		cancel()
+		if !sleep(ctx, calendar_probe_interval) {
+			return
+		}
+	}
+}
+
+func status_report() map[string]interface{} {
+	connected, since := chat_status()
+
+	report := map[string]interface{}{
+		"version":                 VERSION,
+		"commit":                  COMMIT,
+		"profile":                 TEAM,
+		"connected":               connected,
+		"reminders":               len(pending_reminders()),
+		"scheduled_notifications": len(pending_notifications()),
+	}
+	if connected {
+		report["connected_since"] = since.Format(time.RFC3339)
+	}
+
+	STATUS.Lock()
+	defer STATUS.Unlock()
+	report["started"] = STATUS.started.Format(time.RFC3339)
+	report["uptime_seconds"] = int64(time.Since(STATUS.started).Seconds())
+	report["latency_ms"] = STATUS.latency.Nanoseconds() / int64(time.Millisecond)
+	if !STATUS.calendar_ok.IsZero() {
+		report["calendar_ok"] = STATUS.calendar_ok.Format(time.RFC3339)
+	}
+	if STATUS.calendar_error != "" {
+		report["calendar_error"] = STATUS.calendar_error
+		report["calendar_error_at"] = STATUS.calendar_error_at.Format(time.RFC3339)
+	}
+	return report
+}
+
+// serve_health runs the health and status endpoints on addr until ctx is
+// cancelled.
+func serve_health(ctx context.Context, addr string) {
+	log := logger("HTTP").With("addr", addr)
+	server := &http.Server{Addr: addr, Handler: health_handler()}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	log.Info("Serving health checks")
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Error("Health server failed", "error", err)
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	irc_max_line   = 400
+	irc_line_delay = 500 * time.Millisecond
+)
+
+// ircAdapter connects to one IRC server and joins the profile's channels.
+// Channels are "#name" and a DM is just a nick to PRIVMSG. Users are full
+// nick!user@host masks rather than nicks, since anyone can /nick to an
+// admin's nick but the host is the server's to give.
+// IRC has no message ids or threads, so Edit and React aren't supported and
+// threaded replies go to the channel.
+type ircAdapter struct {
+	server   string
+	nick     string
+	password string
+	channels []string
+	tls      bool
+
+	sync.Mutex
+	conn      net.Conn
+	connected bool
+	current   string
+}
+
+func new_irc_adapter(server, nick, password string, channels []string, use_tls bool) *ircAdapter {
+	return &ircAdapter{server: server, nick: nick, password: password, channels: channels, tls: use_tls}
+}
+
+func (c *ircAdapter) Connected() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.connected
+}
+
+// Run keeps a connection to the server open, reconnecting with backoff
+// whenever it drops.
+func (c *ircAdapter) Run(ctx context.Context, incoming chan Message) {
+	log := logger("IRC")
+	attempt := 0
+	for {
+		started := time.Now()
+		err := c.session(ctx, incoming)
+		c.Lock()
+		c.conn, c.connected = nil, false
+		c.Unlock()
+		if ctx.Err() != nil {
+			return
+		}
+
+		if time.Since(started) > time.Minute {
+			attempt = 0
+		}
+		attempt++
+		wait := backoff(attempt, rtm_min_backoff, rtm_max_backoff)
+		log.Warn("Lost connection", "reason", err, "retry_in", wait)
+		CHAT_RECONNECTS.Inc()
+		if !sleep(ctx, wait) {
+			return
+		}
+	}
+}
+
+func (c *ircAdapter) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	if c.tls {
+		return tls.DialWithDialer(dialer, "tcp", c.server, nil)
+	}
+	return dialer.Dial("tcp", c.server)
+}
+
+// session runs one connection until it fails or ctx is done.
+func (c *ircAdapter) session(ctx context.Context, incoming chan Message) error {
+	log := logger("IRC")
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	sessionCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-sessionCtx.Done()
+		if ctx.Err() != nil {
+			conn.SetWriteDeadline(time.Now().Add(time.Second))
+			conn.Write([]byte("QUIT :Shutting down\r\n"))
+		}
+		conn.Close()
+	}()
+
+	c.Lock()
+	c.conn, c.current = conn, c.nick
+	c.Unlock()
+	if c.password != "" {
+		c.write("PASS " + c.password)
+	}
+	c.write("NICK " + c.nick)
+	c.write("USER " + c.nick + " 0 * :dx_cal_bot")
+
+	reader := bufio.NewReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Minute))
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		prefix, command, params := parse_irc_line(strings.TrimRight(line, "\r\n"))
+
+		switch command {
+		case "PING":
+			c.write("PONG :" + strings.Join(params, " "))
+		case "001":
+			for _, channel := range c.channels {
+				c.write("JOIN " + channel)
+			}
+			c.Lock()
+			c.connected = true
+			c.Unlock()
+			log.Info("Connected to IRC", "server", c.server, "nick", c.current)
+			chat_connected()
+		case "433":
+			// Nick in use: try again with a _ on the end.
+			c.Lock()
+			c.current += "_"
+			nick := c.current
+			c.Unlock()
+			c.write("NICK " + nick)
+		case "ERROR":
+			return fmt.Errorf("server closed the connection: %s", strings.Join(params, " "))
+		case "PRIVMSG":
+			if len(params) < 2 {
+				continue
+			}
+			nick := irc_nick(prefix)
+			// Messages sent to us rather than a channel are answered privately.
+			channel := params[0]
+			if !strings.HasPrefix(channel, "#") && !strings.HasPrefix(channel, "&") {
+				channel = nick
+			}
+			select {
+			case incoming <- Message{UserId: prefix, ChannelId: channel, Text: params[1], Direct: channel == nick}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		default:
+			log.Debug("Unexpected / Don't Care", "command", command)
+		}
+	}
+}
+
+// parse_irc_line splits ":prefix COMMAND a b :trailing text" into its parts.
+func parse_irc_line(line string) (prefix, command string, params []string) {
+	if strings.HasPrefix(line, ":") {
+		if i := strings.Index(line, " "); i >= 0 {
+			prefix, line = line[1:i], line[i+1:]
+		} else {
+			return line[1:], "", nil
+		}
+	}
+	trailing := ""
+	has_trailing := false
+	if i := strings.Index(line, " :"); i >= 0 {
+		line, trailing, has_trailing = line[:i], line[i+2:], true
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return prefix, "", nil
+	}
+	params = fields[1:]
+	if has_trailing {
+		params = append(params, trailing)
+	}
+	return prefix, strings.ToUpper(fields[0]), params
+}
+
+// irc_nick is the nick in a nick!user@host mask.
+func irc_nick(mask string) string {
+	if i := strings.Index(mask, "!"); i >= 0 {
+		return mask[:i]
+	}
+	return mask
+}
+
+func (c *ircAdapter) write(line string) error {
+	c.Lock()
+	conn := c.conn
+	c.Unlock()
+	if conn == nil {
+		return ErrNotConnected
+	}
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err := conn.Write([]byte(line + "\r\n"))
+	return err
+}
+
+// irc_lines breaks text into lines short enough to send, splitting long ones
+// between words.
+func irc_lines(text string) []string {
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimRight(line, " \r")
+		for len(line) > irc_max_line {
+			cut := strings.LastIndex(line[:irc_max_line], " ")
+			if cut <= 0 {
+				cut = irc_max_line
+			}
+			lines = append(lines, line[:cut])
+			line = strings.TrimLeft(line[cut:], " ")
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// Send writes one PRIVMSG per line, spaced out so the server doesn't kick
+// the bot for flooding. Users are mentioned by nick.
+func (c *ircAdapter) Send(msg Message) (string, error) {
+	if !c.Connected() {
+		return "", ErrNotConnected
+	}
+	text := slack_mention_rx.ReplaceAllStringFunc(msg.Text, func(mention string) string {
+		if m := slack_mention_rx.FindStringSubmatch(mention); m[2] == "" && strings.Contains(m[1], "!") {
+			return irc_nick(m[1])
+		}
+		return mention
+	})
+	for i, line := range irc_lines(plain_text(text)) {
+		if i > 0 {
+			time.Sleep(irc_line_delay)
+		}
+		if err := c.write("PRIVMSG " + msg.ChannelId + " :" + line); err != nil {
+			return "", err
+		}
+	}
+	return "", nil
+}
+
+func (c *ircAdapter) Edit(channel, id, text string) error {
+	return ErrNotSupported
+}
+
+func (c *ircAdapter) React(channel, id, emoji string) error {
+	return ErrNotSupported
+}
+
+func (c *ircAdapter) DM(user string) (string, error) {
+	return irc_nick(user), nil
+}
+
+func (c *ircAdapter) User(id string) (ChatUser, error) {
+	return ChatUser{Id: id, Name: irc_nick(id)}, nil
+}
+
+// Users is empty: nicks come and go, and IRC has no emails to match
+// attendees with.
+func (c *ircAdapter) Users() ([]ChatUser, error) {
+	return nil, nil
+}
+
+func (c *ircAdapter) Channel(name string) (string, error) {
+	return "#" + strings.TrimPrefix(name, "#"), nil
+}
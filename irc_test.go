@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeIRC is one client's connection to a fake IRC server.
+type fakeIRC struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// listen_irc starts a fake server and returns its address and the first
+// connection made to it.
+func listen_irc(t *testing.T) (string, chan *fakeIRC) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	accepted := make(chan *fakeIRC, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		t.Cleanup(func() { conn.Close() })
+		accepted <- &fakeIRC{t: t, conn: conn, reader: bufio.NewReader(conn)}
+	}()
+	return listener.Addr().String(), accepted
+}
+
+func (f *fakeIRC) send(line string) {
+	if _, err := f.conn.Write([]byte(line + "\r\n")); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+// expect reads the next line from the bot, which must be want.
+func (f *fakeIRC) expect(want string) {
+	f.t.Helper()
+	f.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := f.reader.ReadString('\n')
+	if err != nil {
+		f.t.Fatalf("waiting for %q: %s", want, err)
+	}
+	if got := strings.TrimRight(line, "\r\n"); got != want {
+		f.t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestIRCSession(t *testing.T) {
+	addr, accepted := listen_irc(t)
+	c := new_irc_adapter(addr, "calbot", "secret", []string{"#team", "#ops"}, false)
+	incoming := make(chan Message, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.session(ctx, incoming)
+
+	var server *fakeIRC
+	select {
+	case server = <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the bot never connected")
+	}
+
+	server.expect("PASS secret")
+	server.expect("NICK calbot")
+	server.expect("USER calbot 0 * :dx_cal_bot")
+
+	server.send("PING :irc.example.org")
+	server.expect("PONG :irc.example.org")
+
+	// The nick is taken, so the bot tries another.
+	server.send(":irc.example.org 433 * calbot :Nickname is already in use")
+	server.expect("NICK calbot_")
+	if c.Connected() {
+		t.Error("connected before registering")
+	}
+
+	server.send(":irc.example.org 001 calbot_ :Welcome")
+	server.expect("JOIN #team")
+	server.expect("JOIN #ops")
+	if !c.Connected() {
+		t.Error("not connected after registering")
+	}
+
+	server.send(":alice!~alice@alice.example.org PRIVMSG #team :^events today")
+	server.send(":bob!~bob@bob.example.org PRIVMSG calbot_ :events tomorrow")
+	want := []Message{
+		{UserId: "alice!~alice@alice.example.org", ChannelId: "#team", Text: "^events today"},
+		{UserId: "bob!~bob@bob.example.org", ChannelId: "bob", Text: "events tomorrow", Direct: true},
+	}
+	for _, w := range want {
+		select {
+		case got := <-incoming:
+			if got.UserId != w.UserId || got.ChannelId != w.ChannelId || got.Text != w.Text || got.Direct != w.Direct {
+				t.Errorf("got %+v, want %+v", got, w)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("never got %q", w.Text)
+		}
+	}
+
+	// Replies mention users by nick, and DM by nick too.
+	if channel, _ := c.DM(want[1].UserId); channel != "bob" {
+		t.Errorf("DM channel = %q, want bob", channel)
+	}
+	if _, err := c.Send(Message{ChannelId: "#team", Text: "Done, <@" + want[0].UserId + ">\nsecond line"}); err != nil {
+		t.Fatal(err)
+	}
+	server.expect("PRIVMSG #team :Done, alice")
+	server.expect("PRIVMSG #team :second line")
+
+	cancel()
+	server.expect("QUIT :Shutting down")
+}
+
+func TestIRCLines(t *testing.T) {
+	long := strings.Repeat("word ", 200)
+	unbroken := strings.Repeat("x", irc_max_line+10)
+
+	tests := []struct {
+		name string
+		text string
+		want []int
+	}{
+		{"short", "hello", []int{5}},
+		{"lines", "one\r\n\ntwo  ", []int{3, 3}},
+		{"split between words", long, []int{399, 399, 199}},
+		{"no spaces", unbroken, []int{irc_max_line, 10}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lines := irc_lines(test.text)
+			if len(lines) != len(test.want) {
+				t.Fatalf("got %d lines %q, want %d", len(lines), lines, len(test.want))
+			}
+			for i, line := range lines {
+				if len(line) != test.want[i] {
+					t.Errorf("line %d is %d long, want %d", i, len(line), test.want[i])
+				}
+			}
+			if strings.Join(strings.Fields(strings.Join(lines, "")), "") != strings.Join(strings.Fields(test.text), "") {
+				t.Error("text was lost or added")
+			}
+		})
+	}
+}
+
+func TestParseIRCLine(t *testing.T) {
+	tests := []struct {
+		line    string
+		prefix  string
+		command string
+		params  []string
+	}{
+		{"PING :irc.example.org", "", "PING", []string{"irc.example.org"}},
+		{":a!b@c PRIVMSG #team :hello there", "a!b@c", "PRIVMSG", []string{"#team", "hello there"}},
+		{":irc.example.org 433 * calbot :Nickname is already in use", "irc.example.org", "433", []string{"*", "calbot", "Nickname is already in use"}},
+		{"privmsg bob", "", "PRIVMSG", []string{"bob"}},
+		{":lonely", "lonely", "", nil},
+	}
+	for _, test := range tests {
+		prefix, command, params := parse_irc_line(test.line)
+		if prefix != test.prefix || command != test.command || strings.Join(params, "|") != strings.Join(test.params, "|") {
+			t.Errorf("parse_irc_line(%q) = %q, %q, %q", test.line, prefix, command, params)
+		}
+	}
+}
+
+func TestIRCConnectOneshot(t *testing.T) {
+	addr, accepted := listen_irc(t)
+	CHAT = new_irc_adapter(addr, "calbot", "", []string{"#team"}, false)
+	defer func() { CHAT = nil }()
+
+	served := make(chan bool)
+	go func() {
+		defer close(served)
+		server := <-accepted
+		server.expect("NICK calbot")
+		server.expect("USER calbot 0 * :dx_cal_bot")
+		server.send(":irc.example.org 001 calbot :Welcome")
+		server.expect("JOIN #team")
+		server.expect("PRIVMSG #team :Good Morning!")
+		server.expect("QUIT :Shutting down")
+	}()
+
+	disconnect, err := connect_oneshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CHAT.Send(Message{ChannelId: "#team", Text: "Good Morning!"}); err != nil {
+		t.Fatal(err)
+	}
+	disconnect()
+	if CHAT.Connected() {
+		t.Error("still connected after disconnecting")
+	}
+	<-served
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// LIFECYCLE lets any part of the bot ask for a shutdown, optionally followed
+// by re-executing the same binary in place.
+var LIFECYCLE struct {
+	sync.Mutex
+	cancel  context.CancelFunc
+	restart bool
+}
+
+func shutdown(restart bool) {
+	LIFECYCLE.Lock()
+	defer LIFECYCLE.Unlock()
+
+	LIFECYCLE.restart = LIFECYCLE.restart || restart
+	if LIFECYCLE.cancel != nil {
+		LIFECYCLE.cancel()
+	}
+}
+
+func restart_requested() bool {
+	LIFECYCLE.Lock()
+	defer LIFECYCLE.Unlock()
+	return LIFECYCLE.restart
+}
+
+// lifecycle_context returns the context every long running goroutine should
+// watch. It is cancelled by shutdown.
+func lifecycle_context() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	LIFECYCLE.Lock()
+	LIFECYCLE.cancel = cancel
+	LIFECYCLE.Unlock()
+	return ctx
+}
+
+// handle_signals shuts down on SIGINT/SIGTERM and reloads the config on
+// SIGHUP.
+func handle_signals(ctx context.Context) {
+	log := logger("SIGNAL")
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case sig := <-signals:
+			log.Info("Received signal", "signal", sig)
+			if sig == syscall.SIGHUP {
+				request_reload(ctx, "SIGHUP")
+				continue
+			}
+			shutdown(false)
+			return
+		}
+	}
+}
+
+// sleep waits for d, returning false early if ctx is cancelled first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// reexec replaces the running process with a fresh copy of itself, keeping
+// the same arguments and environment.
+func reexec() error {
+	path, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	return syscall.Exec(path, os.Args, os.Environ())
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rotatingFile is the log file. It starts a new file once the current one is
+// too big or too old, gzips the old one, and deletes compressed logs beyond
+// the retention limits. Every file's name starts with the profile, so bots for
+// other profiles can share the directory without touching each other's logs.
+type rotatingFile struct {
+	sync.Mutex
+	compressing sync.Mutex
+
+	dir    string
+	prefix string
+	file   *os.File
+	size   int64
+	opened time.Time
+
+	max_size  int64
+	max_age   time.Duration
+	keep      int
+	keep_days int
+}
+
+// log_time names log files. It sorts in the order they were opened and, unlike
+// RFC3339, doesn't repeat when a big burst rotates twice in a second.
+const log_time = "2006-01-02T15:04:05.000000000Z07:00"
+
+func open_log_dir(dir, prefix string) (*rotatingFile, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	r := &rotatingFile{dir: dir, prefix: prefix + "-"}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// set_limits changes when the file rotates and how many old logs are kept,
+// then tidies up the logs left by earlier runs. Zero means no limit.
+func (r *rotatingFile) set_limits(max_size int64, max_age time.Duration, keep, keep_days int) {
+	r.Lock()
+	r.max_size = max_size
+	r.max_age = max_age
+	r.keep = keep
+	r.keep_days = keep_days
+	r.Unlock()
+
+	go r.compress_old()
+}
+
+// open starts a new file, never reopening an old one. It must be called with
+// r locked (or before r is shared).
+func (r *rotatingFile) open() error {
+	now := time.Now()
+	for {
+		name := filepath.Join(r.dir, r.prefix+now.Format(log_time)+".log")
+		file, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0644)
+		if os.IsExist(err) {
+			now = now.Add(time.Nanosecond)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		r.file = file
+		r.size = 0
+		r.opened = now
+		return nil
+	}
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.file == nil {
+		return 0, os.ErrClosed
+	}
+	too_big := r.max_size > 0 && r.size+int64(len(p)) > r.max_size && r.size > 0
+	too_old := r.max_age > 0 && time.Since(r.opened) > r.max_age
+	if too_big || too_old {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate must be called with r locked.
+func (r *rotatingFile) rotate() error {
+	old := r.file
+	if err := r.open(); err != nil {
+		return err
+	}
+	old.Close()
+	go r.compress_old()
+	return nil
+}
+
+func (r *rotatingFile) Close() error {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+// compress_old gzips every log of this profile except the one being written,
+// then applies the retention limits to them.
+func (r *rotatingFile) compress_old() {
+	r.compressing.Lock()
+	defer r.compressing.Unlock()
+
+	r.Lock()
+	current := ""
+	if r.file != nil {
+		current = r.file.Name()
+	}
+	keep, keep_days := r.keep, r.keep_days
+	r.Unlock()
+
+	names, _ := filepath.Glob(filepath.Join(r.dir, "*.log"))
+	for _, name := range names {
+		if name != current && r.owns(name, ".log") {
+			gzip_file(name)
+		}
+	}
+
+	var old []string
+	zipped, _ := filepath.Glob(filepath.Join(r.dir, "*.log.gz"))
+	for _, name := range zipped {
+		if r.owns(name, ".log.gz") {
+			old = append(old, name)
+		}
+	}
+	sort.Strings(old)
+	for i, name := range old {
+		expired := false
+		if keep > 0 && i < len(old)-keep {
+			expired = true
+		}
+		if stat, err := os.Stat(name); err == nil && keep_days > 0 && time.Since(stat.ModTime()) > time.Duration(keep_days)*24*time.Hour {
+			expired = true
+		}
+		if expired {
+			os.Remove(name)
+		}
+	}
+}
+
+// owns reports whether name is one of this profile's logs. The time has to
+// follow the prefix directly, or profile "team" would claim "team-b"'s logs.
+func (r *rotatingFile) owns(name, suffix string) bool {
+	base := filepath.Base(name)
+	if !strings.HasPrefix(base, r.prefix) || !strings.HasSuffix(base, suffix) {
+		return false
+	}
+	_, err := time.Parse(log_time, strings.TrimSuffix(strings.TrimPrefix(base, r.prefix), suffix))
+	return err == nil
+}
+
+func gzip_file(name string) error {
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+".gz.")
+	if err != nil {
+		return err
+	}
+	zipped := gzip.NewWriter(out)
+	_, err = io.Copy(zipped, in)
+	if err == nil {
+		err = zipped.Close()
+	}
+	if err == nil {
+		err = out.Close()
+	} else {
+		out.Close()
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return err
+	}
+
+	if err := os.Rename(out.Name(), strings.TrimSuffix(name, ".log")+".log.gz"); err != nil {
+		os.Remove(out.Name())
+		return err
+	}
+	return os.Remove(name)
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const matrix_sync_timeout = 30 * time.Second
+
+// matrix_sync_filter turns on lazy loading of members, without which
+// homeservers leave out the room summary Run counts members with.
+const matrix_sync_filter = `{"room":{"state":{"lazy_load_members":true}}}`
+
+// matrixAdapter talks to a Matrix homeserver through the client-server API,
+// long-polling /sync for messages. Channels are room ids and users are full
+// user ids (@bot:example.org).
+type matrixAdapter struct {
+	homeserver string
+	token      string
+	client     *http.Client
+
+	sync.Mutex
+	connected bool
+	self      string
+	txn       int64
+	members   map[string]int
+}
+
+func new_matrix_adapter(homeserver, token string) *matrixAdapter {
+	return &matrixAdapter{
+		homeserver: strings.TrimSuffix(homeserver, "/"),
+		token:      token,
+		client:     &http.Client{Timeout: matrix_sync_timeout + 15*time.Second},
+		txn:        time.Now().UnixNano(),
+		members:    make(map[string]int),
+	}
+}
+
+// call makes a client-server API request. The homeserver's M_LIMIT_EXCEEDED
+// and 5xxs are temporary; any other refusal is not.
+func (m *matrixAdapter) call(ctx context.Context, method, path string, body, reply interface{}) error {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	request, err := http.NewRequest(method, m.homeserver+"/_matrix/client/v3"+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("Authorization", "Bearer "+m.token)
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	response, err := m.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	text, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		var failure struct {
+			Code  string `json:"errcode"`
+			Error string `json:"error"`
+		}
+		json.Unmarshal(text, &failure)
+		return &chatError{
+			Message:   fmt.Sprintf("matrix %s %s: %d %s %s", method, path, response.StatusCode, failure.Code, failure.Error),
+			Temporary: failure.Code == "M_LIMIT_EXCEEDED" || response.StatusCode >= 500,
+		}
+	}
+	if reply != nil && len(text) > 0 {
+		return json.Unmarshal(text, reply)
+	}
+	return nil
+}
+
+func (m *matrixAdapter) Connected() bool {
+	m.Lock()
+	defer m.Unlock()
+	return m.connected
+}
+
+func (m *matrixAdapter) set_connected(connected bool) {
+	m.Lock()
+	m.connected = connected
+	m.Unlock()
+}
+
+type matrixEvent struct {
+	Type    string `json:"type"`
+	Id      string `json:"event_id"`
+	Sender  string `json:"sender"`
+	Content struct {
+		MsgType   string `json:"msgtype"`
+		Body      string `json:"body"`
+		RelatesTo struct {
+			Type    string `json:"rel_type"`
+			EventId string `json:"event_id"`
+		} `json:"m.relates_to"`
+	} `json:"content"`
+}
+
+type matrixSync struct {
+	NextBatch string `json:"next_batch"`
+	Rooms     struct {
+		Join map[string]struct {
+			Summary struct {
+				Joined *int `json:"m.joined_member_count"`
+			} `json:"summary"`
+			Timeline struct {
+				Events []matrixEvent `json:"events"`
+			} `json:"timeline"`
+		} `json:"join"`
+		Invite map[string]json.RawMessage `json:"invite"`
+	} `json:"rooms"`
+}
+
+// Run syncs until ctx is done, backing off whenever the homeserver can't be
+// reached. The first sync only finds out where "now" is, so messages sent
+// while the bot was away aren't answered late. Invites are accepted, and a
+// room with just the bot and one other person counts as a direct message.
+func (m *matrixAdapter) Run(ctx context.Context, incoming chan Message) {
+	log := logger("MATRIX")
+	attempt := 0
+	since := ""
+	for {
+		if m.self == "" {
+			var whoami struct {
+				UserId string `json:"user_id"`
+			}
+			if err := m.call(ctx, "GET", "/account/whoami", nil, &whoami); err != nil {
+				if !m.retry(ctx, &attempt, err) {
+					return
+				}
+				continue
+			}
+			m.Lock()
+			m.self = whoami.UserId
+			m.Unlock()
+		}
+
+		path := "/sync?timeout=0&filter=" + url.QueryEscape(matrix_sync_filter)
+		if since != "" {
+			path = "/sync?timeout=" + strconv.Itoa(int(matrix_sync_timeout/time.Millisecond)) + "&filter=" + url.QueryEscape(matrix_sync_filter) + "&since=" + url.QueryEscape(since)
+		}
+		var batch matrixSync
+		if err := m.call(ctx, "GET", path, nil, &batch); err != nil {
+			if !m.retry(ctx, &attempt, err) {
+				return
+			}
+			continue
+		}
+		if !m.Connected() {
+			m.set_connected(true)
+			log.Info("Connected to Matrix", "user", m.self)
+			chat_connected()
+		}
+		attempt = 0
+
+		for room := range batch.Rooms.Invite {
+			if err := m.call(ctx, "POST", "/rooms/"+url.PathEscape(room)+"/join", struct{}{}, nil); err != nil {
+				log.Warn("Couldn't accept invite", "room", room, "error", err)
+			} else {
+				log.Info("Joined room", "room", room)
+			}
+		}
+		for room, joined := range batch.Rooms.Join {
+			// The summary only comes when the count changes.
+			if joined.Summary.Joined != nil {
+				m.members[room] = *joined.Summary.Joined
+			}
+		}
+		if since != "" {
+			for room, joined := range batch.Rooms.Join {
+				for _, event := range joined.Timeline.Events {
+					if event.Type != "m.room.message" || event.Content.MsgType != "m.text" || event.Sender == m.self {
+						continue
+					}
+					thread := ""
+					if event.Content.RelatesTo.Type == "m.thread" {
+						thread = event.Content.RelatesTo.EventId
+					}
+					select {
+					case incoming <- Message{Id: event.Id, UserId: event.Sender, ChannelId: room, Text: event.Content.Body, ThreadId: thread, Direct: m.members[room] == 2}:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+		}
+		since = batch.NextBatch
+	}
+}
+
+// retry waits out a failed request and reports whether to carry on.
+func (m *matrixAdapter) retry(ctx context.Context, attempt *int, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if m.Connected() {
+		m.set_connected(false)
+		CHAT_RECONNECTS.Inc()
+	}
+	*attempt++
+	wait := backoff(*attempt, rtm_min_backoff, rtm_max_backoff)
+	logger("MATRIX").Warn("Lost connection", "reason", err, "retry_in", wait)
+	return sleep(ctx, wait)
+}
+
+// send puts an event in a room; every event needs its own transaction id.
+func (m *matrixAdapter) send(room, kind string, content interface{}) (string, error) {
+	m.Lock()
+	m.txn++
+	txn := strconv.FormatInt(m.txn, 10)
+	m.Unlock()
+
+	var reply struct {
+		Id string `json:"event_id"`
+	}
+	err := m.call(context.Background(), "PUT", "/rooms/"+url.PathEscape(room)+"/send/"+kind+"/"+txn, content, &reply)
+	return reply.Id, err
+}
+
+func (m *matrixAdapter) Send(msg Message) (string, error) {
+	content := map[string]interface{}{"msgtype": "m.text", "body": plain_text(msg.Text)}
+	if msg.ThreadId != "" {
+		content["m.relates_to"] = map[string]interface{}{"rel_type": "m.thread", "event_id": msg.ThreadId}
+	}
+	return m.send(msg.ChannelId, "m.room.message", content)
+}
+
+// Edit sends a replacement, which clients show in place of the original.
+func (m *matrixAdapter) Edit(channel, id, text string) error {
+	body := plain_text(text)
+	_, err := m.send(channel, "m.room.message", map[string]interface{}{
+		"msgtype":       "m.text",
+		"body":          "* " + body,
+		"m.new_content": map[string]string{"msgtype": "m.text", "body": body},
+		"m.relates_to":  map[string]string{"rel_type": "m.replace", "event_id": id},
+	})
+	return err
+}
+
+// React takes the emoji itself, not a name.
+func (m *matrixAdapter) React(channel, id, emoji string) error {
+	_, err := m.send(channel, "m.reaction", map[string]interface{}{
+		"m.relates_to": map[string]string{"rel_type": "m.annotation", "event_id": id, "key": emoji},
+	})
+	return err
+}
+
+// DM reuses the direct chat recorded in the bot's m.direct account data, and
+// creates (and records) one otherwise.
+func (m *matrixAdapter) DM(user string) (string, error) {
+	ctx := context.Background()
+	m.Lock()
+	self := m.self
+	m.Unlock()
+	if self == "" {
+		return "", ErrNotConnected
+	}
+
+	direct := make(map[string][]string)
+	path := "/user/" + url.PathEscape(self) + "/account_data/m.direct"
+	if err := m.call(ctx, "GET", path, nil, &direct); err != nil && temporary(err) {
+		return "", err
+	}
+	if rooms := direct[user]; len(rooms) > 0 {
+		return rooms[len(rooms)-1], nil
+	}
+
+	var room struct {
+		Id string `json:"room_id"`
+	}
+	err := m.call(ctx, "POST", "/createRoom", map[string]interface{}{
+		"is_direct": true,
+		"invite":    []string{user},
+		"preset":    "trusted_private_chat",
+	}, &room)
+	if err != nil {
+		return "", err
+	}
+	direct[user] = append(direct[user], room.Id)
+	if err := m.call(ctx, "PUT", path, direct, nil); err != nil {
+		logger("MATRIX").Warn("Couldn't record the direct chat", "user", user, "error", err)
+	}
+	return room.Id, nil
+}
+
+func (m *matrixAdapter) User(id string) (ChatUser, error) {
+	var profile struct {
+		Name string `json:"displayname"`
+	}
+	if err := m.call(context.Background(), "GET", "/profile/"+url.PathEscape(id), nil, &profile); err != nil {
+		return ChatUser{}, err
+	}
+	if profile.Name == "" {
+		profile.Name = id
+	}
+	return ChatUser{Id: id, Name: profile.Name}, nil
+}
+
+// Users lists everyone in the rooms the bot has joined. Matrix doesn't share
+// emails or timezones, so attendees can't be matched up with them.
+func (m *matrixAdapter) Users() ([]ChatUser, error) {
+	ctx := context.Background()
+	var joined struct {
+		Rooms []string `json:"joined_rooms"`
+	}
+	if err := m.call(ctx, "GET", "/joined_rooms", nil, &joined); err != nil {
+		return nil, err
+	}
+
+	var users []ChatUser
+	seen := map[string]bool{m.self: true}
+	for _, room := range joined.Rooms {
+		var members struct {
+			Joined map[string]struct {
+				Name string `json:"display_name"`
+			} `json:"joined"`
+		}
+		if err := m.call(ctx, "GET", "/rooms/"+url.PathEscape(room)+"/joined_members", nil, &members); err != nil {
+			return nil, err
+		}
+		for id, member := range members.Joined {
+			if !seen[id] {
+				seen[id] = true
+				users = append(users, ChatUser{Id: id, Name: member.Name})
+			}
+		}
+	}
+	return users, nil
+}
+
+// Channel looks up a room alias. A bare name is taken to be on the bot's own
+// homeserver.
+func (m *matrixAdapter) Channel(name string) (string, error) {
+	alias := "#" + strings.TrimPrefix(name, "#")
+	if !strings.Contains(alias, ":") {
+		m.Lock()
+		self := m.self
+		m.Unlock()
+		if i := strings.Index(self, ":"); i >= 0 {
+			alias += self[i:]
+		}
+	}
+	var room struct {
+		Id string `json:"room_id"`
+	}
+	if err := m.call(context.Background(), "GET", "/directory/room/"+url.PathEscape(alias), nil, &room); err != nil {
+		return "", fmt.Errorf("I don't know a room called %s", alias)
+	}
+	return room.Id, nil
+}
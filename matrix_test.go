@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeHomeserver answers whoami and /sync, handing out one canned batch per
+// sync and then holding the long poll open. Like a real homeserver, it only
+// includes room summaries when the sync filter lazy loads members.
+// Everything else is recorded.
+type fakeHomeserver struct {
+	server  *httptest.Server
+	batches []string
+
+	sync.Mutex
+	calls []string
+}
+
+func new_fake_homeserver(t *testing.T, batches ...string) *fakeHomeserver {
+	f := &fakeHomeserver{batches: batches}
+	f.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer TOKEN" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"errcode":"M_UNKNOWN_TOKEN","error":"bad token"}`))
+			return
+		}
+		path := strings.TrimPrefix(r.URL.Path, "/_matrix/client/v3")
+		body, _ := ioutil.ReadAll(r.Body)
+		f.Lock()
+		f.calls = append(f.calls, r.Method+" "+path+" "+string(body))
+		f.Unlock()
+
+		switch {
+		case path == "/account/whoami":
+			w.Write([]byte(`{"user_id":"@bot:example.org"}`))
+		case path == "/sync":
+			f.Lock()
+			next := len(f.batches) > 0
+			batch := ""
+			if next {
+				batch, f.batches = f.batches[0], f.batches[1:]
+			}
+			f.Unlock()
+			if !next {
+				<-r.Context().Done()
+				return
+			}
+			var filter struct {
+				Room struct {
+					State struct {
+						LazyLoadMembers bool `json:"lazy_load_members"`
+					} `json:"state"`
+				} `json:"room"`
+			}
+			json.Unmarshal([]byte(r.URL.Query().Get("filter")), &filter)
+			if !filter.Room.State.LazyLoadMembers {
+				batch = without_summaries(batch)
+			}
+			w.Write([]byte(batch))
+		case strings.Contains(path, "/send/"):
+			w.Write([]byte(`{"event_id":"$sent"}`))
+		default:
+			w.Write([]byte("{}"))
+		}
+	}))
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+// without_summaries drops the summary from every joined room in a sync batch.
+func without_summaries(batch string) string {
+	var parsed map[string]interface{}
+	if err := json.Unmarshal([]byte(batch), &parsed); err != nil {
+		return batch
+	}
+	rooms, _ := parsed["rooms"].(map[string]interface{})
+	joined, _ := rooms["join"].(map[string]interface{})
+	for _, room := range joined {
+		if room, ok := room.(map[string]interface{}); ok {
+			delete(room, "summary")
+		}
+	}
+	stripped, _ := json.Marshal(parsed)
+	return string(stripped)
+}
+
+func (f *fakeHomeserver) requests(method string) []string {
+	f.Lock()
+	defer f.Unlock()
+	var found []string
+	for _, call := range f.calls {
+		if strings.HasPrefix(call, method+" ") {
+			found = append(found, call)
+		}
+	}
+	return found
+}
+
+func text_event(id, sender, body string, relates string) string {
+	content := map[string]interface{}{"msgtype": "m.text", "body": body}
+	if relates != "" {
+		content["m.relates_to"] = map[string]string{"rel_type": "m.thread", "event_id": relates}
+	}
+	event, _ := json.Marshal(map[string]interface{}{"type": "m.room.message", "event_id": id, "sender": sender, "content": content})
+	return string(event)
+}
+
+func TestMatrixSync(t *testing.T) {
+	// The first sync is history: its messages are skipped, but it accepts
+	// invites and learns who is in each room.
+	first := `{"next_batch":"s1","rooms":{
+		"invite":{"!new:example.org":{}},
+		"join":{
+			"!dm:example.org":{"summary":{"m.joined_member_count":2},"timeline":{"events":[` + text_event("$old", "@alice:example.org", "^events", "") + `]}},
+			"!team:example.org":{"summary":{"m.joined_member_count":5}}
+		}}}`
+	second := `{"next_batch":"s2","rooms":{"join":{
+			"!dm:example.org":{"timeline":{"events":[` + text_event("$1", "@alice:example.org", "events today", "") + `]}},
+			"!team:example.org":{"timeline":{"events":[` +
+		text_event("$2", "@bot:example.org", "my own reply", "") + `,` +
+		text_event("$3", "@bob:example.org", "^events in a thread", "$root") + `,` +
+		`{"type":"m.reaction","event_id":"$4","sender":"@bob:example.org","content":{}}` + `]}}
+		}}}`
+	f := new_fake_homeserver(t, first, second)
+	m := new_matrix_adapter(f.server.URL+"/", "TOKEN")
+
+	incoming := make(chan Message, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.Run(ctx, incoming)
+
+	want := []Message{
+		{Id: "$1", UserId: "@alice:example.org", ChannelId: "!dm:example.org", Text: "events today", Direct: true},
+		{Id: "$3", UserId: "@bob:example.org", ChannelId: "!team:example.org", Text: "^events in a thread", ThreadId: "$root"},
+	}
+	var got []Message
+	for len(got) < len(want) {
+		select {
+		case msg := <-incoming:
+			got = append(got, msg)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %d messages, want %d", len(got), len(want))
+		}
+	}
+	// Rooms come out of a map, so their order isn't fixed.
+	if got[0].ChannelId != want[0].ChannelId {
+		got[0], got[1] = got[1], got[0]
+	}
+	for i := range want {
+		if !reflect.DeepEqual(got[i], want[i]) {
+			t.Errorf("got %+v, want %+v", got[i], want[i])
+		}
+	}
+	select {
+	case msg := <-incoming:
+		t.Errorf("unexpected message %+v", msg)
+	default:
+	}
+
+	if !m.Connected() {
+		t.Error("not connected after syncing")
+	}
+	if joins := f.requests("POST"); len(joins) != 1 || !strings.HasPrefix(joins[0], "POST /rooms/!new:example.org/join ") {
+		t.Errorf("joins = %q, want the invited room", joins)
+	}
+}
+
+func TestMatrixSend(t *testing.T) {
+	f := new_fake_homeserver(t)
+	m := new_matrix_adapter(f.server.URL, "TOKEN")
+
+	id, err := m.Send(Message{ChannelId: "!team:example.org", Text: "*Standup* <@@alice:example.org>"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "$sent" {
+		t.Errorf("Send returned %q", id)
+	}
+	if _, err := m.Send(Message{ChannelId: "!team:example.org", ThreadId: "$root", Text: "in the thread"}); err != nil {
+		t.Fatal(err)
+	}
+
+	puts := f.requests("PUT")
+	if len(puts) != 2 {
+		t.Fatalf("got %q, want two sends", puts)
+	}
+	var txns []string
+	for i, put := range puts {
+		fields := strings.SplitN(put, " ", 3)
+		if !strings.HasPrefix(fields[1], "/rooms/!team:example.org/send/m.room.message/") {
+			t.Errorf("send %d went to %s", i, fields[1])
+		}
+		txns = append(txns, fields[1])
+
+		var content struct {
+			Body      string `json:"body"`
+			RelatesTo *struct {
+				Type    string `json:"rel_type"`
+				EventId string `json:"event_id"`
+			} `json:"m.relates_to"`
+		}
+		json.Unmarshal([]byte(fields[2]), &content)
+		switch {
+		case i == 0 && (content.Body != "Standup @alice:example.org" || content.RelatesTo != nil):
+			t.Errorf("first send was %s", fields[2])
+		case i == 1 && (content.RelatesTo == nil || content.RelatesTo.Type != "m.thread" || content.RelatesTo.EventId != "$root"):
+			t.Errorf("threaded send was %s", fields[2])
+		}
+	}
+	if txns[0] == txns[1] {
+		t.Error("both sends used the same transaction id")
+	}
+}
+
+func TestMatrixErrors(t *testing.T) {
+	f := new_fake_homeserver(t)
+	m := new_matrix_adapter(f.server.URL, "WRONG")
+
+	_, err := m.Send(Message{ChannelId: "!team:example.org", Text: "hi"})
+	if err == nil || temporary(err) {
+		t.Errorf("a refused token gave %v, want a permanent error", err)
+	}
+}
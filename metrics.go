@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Metrics are exported at /metrics in the Prometheus text format.
+var (
+	COMMANDS_PROCESSED = new_counter("calbot_commands_total", "Commands processed, by name.", "command")
+	CALENDAR_REQUESTS  = new_counter("calbot_calendar_requests_total", "Calendar API requests, by HTTP status.", "status")
+	CALENDAR_LATENCY   = new_histogram("calbot_calendar_request_duration_seconds", "How long Calendar API requests took.",
+		[]float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 15})
+	CHAT_MESSAGES   = new_counter("calbot_chat_messages_total", "Messages to the chat platform, by whether they were sent, failed to send or were dropped from a full queue.", "result")
+	REMINDER_COUNT  = new_counter("calbot_reminders_total", "Reminders scheduled, fired and cancelled, for ^remind reminders and calendar event notifications.", "kind", "action")
+	CHAT_RECONNECTS = new_counter("calbot_chat_reconnects_total", "Times the connection to the chat platform was lost and had to be reconnected.")
+	RTM_LATENCY     = new_histogram("calbot_rtm_latency_seconds", "Slack websocket latency reported by the RTM library.",
+		[]float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5})
+)
+
+var METRICS struct {
+	sync.Mutex
+	all []*metric
+}
+
+// metric is a counter or histogram, with one series per combination of label
+// values.
+type metric struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+	series  map[string]*series
+}
+
+type series struct {
+	values []string
+	value  float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func new_metric(kind, name, help string, buckets []float64, labels []string) *metric {
+	m := &metric{name: name, help: help, kind: kind, labels: labels, buckets: buckets, series: make(map[string]*series)}
+	if len(labels) == 0 {
+		// Without labels there's only one series, so report it from the start.
+		m.get(nil)
+	}
+	METRICS.Lock()
+	METRICS.all = append(METRICS.all, m)
+	METRICS.Unlock()
+	return m
+}
+
+func new_counter(name, help string, labels ...string) *metric {
+	return new_metric("counter", name, help, nil, labels)
+}
+
+func new_histogram(name, help string, buckets []float64, labels ...string) *metric {
+	return new_metric("histogram", name, help, buckets, labels)
+}
+
+// get must be called with METRICS locked.
+func (m *metric) get(values []string) *series {
+	if len(values) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s wants %d label values, got %d", m.name, len(m.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{values: values, counts: make([]uint64, len(m.buckets))}
+		m.series[key] = s
+	}
+	return s
+}
+
+func (m *metric) Inc(values ...string) {
+	METRICS.Lock()
+	m.get(values).value++
+	METRICS.Unlock()
+}
+
+func (m *metric) Observe(v float64, values ...string) {
+	METRICS.Lock()
+	defer METRICS.Unlock()
+
+	s := m.get(values)
+	for i, bound := range m.buckets {
+		if v <= bound {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+func label_string(names, values []string, extra ...string) string {
+	var pairs []string
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", name, values[i]))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", extra[i], extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func format_float(v float64) string {
+	return fmt.Sprintf("%g", v)
+}
+
+// write_metrics writes every metric in the Prometheus text exposition format.
+func write_metrics(w io.Writer) {
+	METRICS.Lock()
+	defer METRICS.Unlock()
+
+	for _, m := range METRICS.all {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+
+		keys := make([]string, 0, len(m.series))
+		for key := range m.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			s := m.series[key]
+			if m.kind == "counter" {
+				fmt.Fprintf(w, "%s%s %s\n", m.name, label_string(m.labels, s.values), format_float(s.value))
+				continue
+			}
+			for i, bound := range m.buckets {
+				fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, label_string(m.labels, s.values, "le", format_float(bound)), s.counts[i])
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, label_string(m.labels, s.values, "le", "+Inf"), s.count)
+			fmt.Fprintf(w, "%s_sum%s %s\n", m.name, label_string(m.labels, s.values), format_float(s.sum))
+			fmt.Fprintf(w, "%s_count%s %d\n", m.name, label_string(m.labels, s.values), s.count)
+		}
+	}
+}
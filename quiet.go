@@ -0,0 +1,131 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of notification that can be configured separately for quiet hours,
+// e.g. Quiet_Event = defer.
+const (
+	NOTIFY_EVENT    = "event"
+	NOTIFY_REMINDER = "reminder"
+	NOTIFY_CHANGES  = "changes"
+)
+
+// Messages held back by quiet hours until the next morning digest.
+var DIGEST struct {
+	sync.Mutex
+	Items []string
+}
+
+func quiet_action(kind string) string {
+	var action string
+	switch kind {
+	case NOTIFY_EVENT:
+		action = profile().Quiet_Event
+	case NOTIFY_REMINDER:
+		action = profile().Quiet_Reminder
+	case NOTIFY_CHANGES:
+		action = profile().Quiet_Changes
+	}
+	action = strings.ToLower(action)
+	if action == "" {
+		return "defer"
+	}
+	return action
+}
+
+func quiet_clock(clock string) (time.Duration, bool) {
+	if clock == "" {
+		return 0, false
+	}
+	hour, minute, ok := parse_clock(clock)
+	return time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute, ok
+}
+
+// in_quiet_hours reports whether t falls on a quiet day or between Quiet_Start
+// and Quiet_End, which may wrap past midnight.
+func in_quiet_hours(t time.Time) bool {
+	t = t.In(TIMEZONE)
+	for _, day := range profile().Quiet_Days {
+		if wkday, err := get_Wkday(strings.ToLower(day)); err == nil && wkday == t.Weekday() {
+			return true
+		}
+	}
+
+	start, ok1 := quiet_clock(profile().Quiet_Start)
+	end, ok2 := quiet_clock(profile().Quiet_End)
+	if !ok1 || !ok2 || start == end {
+		return false
+	}
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, TIMEZONE)
+	now := t.Sub(midnight)
+	if start < end {
+		return now >= start && now < end
+	}
+	return now >= start || now < end
+}
+
+// end_of_quiet_hours finds the first moment after t that isn't quiet, by
+// stepping between midnights and Quiet_End.
+func end_of_quiet_hours(t time.Time) time.Time {
+	t = t.In(TIMEZONE)
+	end, has_end := quiet_clock(profile().Quiet_End)
+	for i := 0; i < 16 && in_quiet_hours(t); i++ {
+		midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, TIMEZONE)
+		next := midnight.AddDate(0, 0, 1)
+		if has_end && midnight.Add(end).After(t) {
+			next = midnight.Add(end)
+		}
+		t = next
+	}
+	return t
+}
+
+// notify sends a notification unless it falls in quiet hours, in which case
+// it is dropped, deferred until the quiet hours end, or saved for the next
+// morning digest depending on the profile's setting for its kind.
+func notify(kind string, msg InternalMessage, chSender chan InternalMessage) {
+	log := logger("QUIET").With("kind", kind)
+	now := time.Now()
+	if !in_quiet_hours(now) {
+		chSender <- msg
+		return
+	}
+
+	action := quiet_action(kind)
+	// Direct messages don't belong in the channel's digest.
+	if action == "digest" && msg.Outgoing.ChannelId != profile().Default_Channel {
+		action = "defer"
+	}
+
+	switch action {
+	case "drop":
+		log.Info("Dropping notification during quiet hours")
+	case "digest":
+		log.Info("Saving notification for the morning digest")
+		DIGEST.Lock()
+		DIGEST.Items = append(DIGEST.Items, msg.Outgoing.Text)
+		DIGEST.Unlock()
+	case "send":
+		chSender <- msg
+	default:
+		until := end_of_quiet_hours(now)
+		log.Info("Deferring notification", "until", until.Format(time.RFC3339))
+		time.AfterFunc(until.Sub(now), func() {
+			chSender <- msg
+		})
+	}
+}
+
+// take_digest returns everything held back for the morning digest.
+func take_digest() []string {
+	DIGEST.Lock()
+	defer DIGEST.Unlock()
+
+	items := DIGEST.Items
+	DIGEST.Items = nil
+	return items
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const config_poll_interval = 5 * time.Second
+
+type reloadRequest struct {
+	reason string
+	done   chan error
+}
+
+// RELOAD hands reload requests from ^reload, SIGHUP and the file watcher to
+// reloader, so only one reload happens at a time.
+var RELOAD = make(chan reloadRequest)
+
+// request_reload asks reloader to reload and waits for the outcome.
+func request_reload(ctx context.Context, reason string) error {
+	request := reloadRequest{reason: reason, done: make(chan error, 1)}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case RELOAD <- request:
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-request.done:
+		return err
+	}
+}
+
+func reloader(ctx context.Context, gApi *http.Client, chSender chan InternalMessage) {
+	log := logger("RELOAD")
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case request := <-RELOAD:
+			err := reload_config()
+			if err != nil {
+				log.Error("Keeping the old config", "reason", request.reason, "error", err)
+			} else {
+				log.Info("Reloaded the config and quotes", "reason", request.reason)
+				start_change_watchers(ctx, gApi, chSender)
+			}
+			request.done <- err
+		}
+	}
+}
+
+// reload_config reads the config and quote files again and, only if both are
+// fine, swaps them in and re-plans everything scheduled from them.
+func reload_config() error {
+	next, err := load_config(CFGFILE)
+	if err != nil {
+		return err
+	}
+	if problems := validate_config(&next, CFGFILE, TEAM, false); len(problems) > 0 {
+		var lines []string
+		for _, p := range problems {
+			lines = append(lines, p.String())
+		}
+		return errors.New(strings.Join(lines, "\n"))
+	}
+	quotes, err := load_quotes(QTEFILE)
+	if err != nil {
+		return err
+	}
+	if err := apply_log_config(next); err != nil {
+		return err
+	}
+
+	if chat_settings(next.Profile[TEAM]) != chat_settings(profile()) {
+		logger("RELOAD").Warn("The chat settings changed; they will be used after a ^restart")
+	}
+	set_config(next)
+	QUOTES_LOCK.Lock()
+	QUOTES = quotes
+	QUOTES_LOCK.Unlock()
+
+	replan_notifications()
+	wake_reminders()
+	return nil
+}
+
+// chat_settings is what new_chat_adapter connects with, which a reload can't
+// change under a running adapter.
+func chat_settings(p *Profile) string {
+	return fmt.Sprintf("%#v", []interface{}{
+		strings.ToLower(p.Chat), p.Slack, p.Slack_Listen, p.Slack_Signing_Secret, p.Discord, p.Discord_Guild, p.Discord_API,
+		p.Matrix, p.Matrix_Homeserver,
+		p.IRC_Server, p.IRC_TLS, p.IRC_Nick, p.IRC_Password, p.IRC_Channel,
+	})
+}
+
+// apply_log_config sets the log level, format and rotation from the [log]
+// section.
+func apply_log_config(config ConfigFile) error {
+	err := configure_logging(nil, config.Log.Format, config.Log.Level, config.Log.Component_Level)
+	if err != nil {
+		return err
+	}
+	redact_secrets(config_secrets(config))
+	if LOGFILE != nil {
+		LOGFILE.set_limits(int64(config.Log.Max_Size)<<20, time.Duration(config.Log.Max_Age)*time.Hour, config.Log.Keep, config.Log.Keep_Days)
+	}
+	return nil
+}
+
+// watch_config_files reloads whenever the config or quote file is saved.
+func watch_config_files(ctx context.Context) {
+	stamp := func() string {
+		var stamp string
+		for _, file := range []string{CFGFILE, QTEFILE} {
+			if stat, err := os.Stat(file); err == nil {
+				stamp += fmt.Sprintf("%s %d %d\n", file, stat.ModTime().UnixNano(), stat.Size())
+			}
+		}
+		return stamp
+	}
+
+	last := stamp()
+	for sleep(ctx, config_poll_interval) {
+		if current := stamp(); current != last {
+			last = current
+			request_reload(ctx, "file changed")
+		}
+	}
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reminder is a one-off message scheduled with ^remind. An empty Channel
+// means the reminder goes to User as a direct message.
+type Reminder struct {
+	Id      int       `json:"id"`
+	User    string    `json:"user"`
+	Channel string    `json:"channel,omitempty"`
+	Text    string    `json:"text"`
+	When    time.Time `json:"when"`
+}
+
+var REMINDERS struct {
+	sync.Mutex
+	Next  int        `json:"next"`
+	Items []Reminder `json:"items"`
+}
+
+// REMINDER_WAKE interrupts reminder_scheduler's sleep whenever the set of
+// reminders changes.
+var REMINDER_WAKE = make(chan bool, 1)
+
+var clock_rx = regexp.MustCompile("(?i)^(\\d{1,2})(?::(\\d\\d))? ?(am|pm)?$")
+var channel_rx = regexp.MustCompile("^<#(\\w+)(?:\\|[^>]*)?>$")
+var weekday_rx = regexp.MustCompile("(?i)^(sun|mon|tues?|wed(?:nes)?|thur?s?|fri|sat)(?:day)?$")
+
+// reminder_retry is how long a reminder that couldn't be delivered waits
+// before it is tried again.
+const reminder_retry = 5 * time.Minute
+
+func wake_reminders() {
+	select {
+	case REMINDER_WAKE <- true:
+	default:
+	}
+}
+
+func load_reminders() error {
+	data, err := ioutil.ReadFile(REMFILE)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	REMINDERS.Lock()
+	defer REMINDERS.Unlock()
+	return json.Unmarshal(data, &REMINDERS)
+}
+
+// save_reminders must be called with REMINDERS locked.
+func save_reminders() error {
+	data, err := json.MarshalIndent(&REMINDERS, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(REMFILE+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(REMFILE+".tmp", REMFILE)
+}
+
+// parse_clock understands "9am", "3:30pm" and "15:00". A bare number is not
+// treated as a time so it can't be confused with the reminder's text.
+func parse_clock(word string) (int, int, bool) {
+	res := clock_rx.FindStringSubmatch(word)
+	if res == nil || (res[2] == "" && res[3] == "") {
+		return 0, 0, false
+	}
+	hour, _ := strconv.Atoi(res[1])
+	minute, _ := strconv.Atoi(res[2])
+	if minute > 59 {
+		return 0, 0, false
+	}
+	switch strings.ToLower(res[3]) {
+	case "am":
+		if hour == 12 {
+			hour = 0
+		}
+	case "pm":
+		if hour < 12 {
+			hour += 12
+		}
+	}
+	if hour > 23 {
+		return 0, 0, false
+	}
+	return hour, minute, true
+}
+
+// parse_when reads a time from the start of words, using the same date
+// grammar as ^events plus "in 20 minutes" and an optional time of day. It
+// returns the time and how many words it used.
+func parse_when(words []string, now time.Time) (time.Time, int, error) {
+	if len(words) > 1 && strings.ToLower(words[0]) == "in" {
+		for n := 2; n >= 1; n-- {
+			if len(words) > n {
+				if d, ok := parse_offset(strings.Join(words[1:1+n], " ")); ok {
+					return now.Add(d), 1 + n, nil
+				}
+			}
+		}
+		return now, 0, dateParseError{input: strings.Join(words, " "), reason: "Expected something like 'in 20 minutes'"}
+	}
+
+	// Dates can't run past the first time of day.
+	date_words := len(words)
+	for i, word := range words {
+		if _, _, ok := parse_clock(word); ok {
+			date_words = i
+			break
+		}
+	}
+	if date_words > 4 {
+		date_words = 4
+	}
+
+	used := 0
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, TIMEZONE)
+	had_date := false
+	// getRange ignores trailing words it doesn't understand, so only take
+	// another word if it changes the answer ("week 3" -> "week 3 tue").
+	var last_end time.Time
+	for n := 1; n <= date_words; n++ {
+		start, end, err := getRange(strings.ToLower(strings.Join(words[:n], " ")))
+		if err == nil && (!had_date || !start.Equal(day) || !end.Equal(last_end)) {
+			day, last_end, used, had_date = start, end, n, true
+		}
+	}
+	date_used := used
+
+	if used < len(words) && strings.ToLower(words[used]) == "at" {
+		used++
+	}
+	hour, minute, had_clock := 9, 0, false
+	if used < len(words) {
+		hour, minute, had_clock = parse_clock(words[used])
+		if had_clock {
+			used++
+		} else {
+			hour, minute = 9, 0
+		}
+	}
+	if !had_date && !had_clock {
+		return now, 0, dateParseError{input: strings.Join(words, " "), reason: "Couldn't find a time"}
+	}
+
+	when := time.Date(day.Year(), day.Month(), day.Day(), hour, minute, 0, 0, TIMEZONE)
+	if !had_date && when.Before(now) {
+		when = when.AddDate(0, 0, 1)
+	} else if date_used == 1 && weekday_rx.MatchString(words[0]) && when.Before(now) {
+		// "friday 9am" said on a Friday afternoon means next Friday.
+		when = when.AddDate(0, 0, 7)
+	}
+	return when, used, nil
+}
+
+func resolve_channel(target string) (string, error) {
+	if res := channel_rx.FindStringSubmatch(target); res != nil {
+		return res[1], nil
+	}
+	return CHAT.Channel(strings.TrimPrefix(target, "#"))
+}
+
+func format_reminder_time(when time.Time) string {
+	when = when.In(TIMEZONE)
+	if when.Sub(time.Now()) < 6*24*time.Hour {
+		return when.Format("Mon 3:04pm")
+	}
+	return when.Format("Mon Jan 2 3:04pm")
+}
+
+func remind(user, channel, args string) string {
+	words := strings.Fields(args)
+	if len(words) < 2 {
+		return "Try `^remind me in 20 minutes to check the build` or `^remind #general friday 9am standup notes`."
+	}
+
+	reminder := Reminder{User: user}
+	switch target := strings.ToLower(words[0]); {
+	case target == "me":
+	case target == "here":
+		reminder.Channel = channel
+	case strings.HasPrefix(target, "#") || channel_rx.MatchString(words[0]):
+		id, err := resolve_channel(words[0])
+		if err != nil {
+			return err.Error()
+		}
+		reminder.Channel = id
+	default:
+		return fmt.Sprintf("I can only remind `me`, `here` or a #channel, <@%s>.", user)
+	}
+
+	when, used, err := parse_when(words[1:], time.Now().In(TIMEZONE))
+	if err != nil {
+		return fmt.Sprintf("I couldn't work out when, <@%s>. Reason: %s", user, err)
+	}
+	if when.Before(time.Now()) {
+		return "That time has already passed."
+	}
+	text := words[1+used:]
+	if len(text) > 0 && strings.ToLower(text[0]) == "to" {
+		text = text[1:]
+	}
+	if len(text) == 0 {
+		return "What should I remind you about?"
+	}
+	reminder.Text = strings.Join(text, " ")
+	reminder.When = when
+
+	REMINDERS.Lock()
+	defer REMINDERS.Unlock()
+
+	REMINDERS.Next++
+	reminder.Id = REMINDERS.Next
+	REMINDERS.Items = append(REMINDERS.Items, reminder)
+	if err := save_reminders(); err != nil {
+		return "I couldn't save that reminder: " + err.Error()
+	}
+	wake_reminders()
+	REMINDER_COUNT.Inc("remind", "scheduled")
+
+	where := "you"
+	if reminder.Channel != "" {
+		where = "<#" + reminder.Channel + ">"
+	}
+	return fmt.Sprintf("Okay, I'll remind %s %s (#%d).", where, format_reminder_time(when), reminder.Id)
+}
+
+func list_reminders(user string) string {
+	REMINDERS.Lock()
+	defer REMINDERS.Unlock()
+
+	var reply string
+	for _, r := range REMINDERS.Items {
+		if r.User != user {
+			continue
+		}
+		where := "you"
+		if r.Channel != "" {
+			where = "<#" + r.Channel + ">"
+		}
+		reply += fmt.Sprintf("\n#%d %s → %s: %s", r.Id, format_reminder_time(r.When), where, r.Text)
+	}
+	if reply == "" {
+		return "You don't have any reminders."
+	}
+	return "Your reminders:" + reply
+}
+
+func cancel_reminder(user, id string) string {
+	n, err := strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(id), "#"))
+	if err != nil {
+		return "Which reminder? Try `^reminders cancel 3`."
+	}
+
+	REMINDERS.Lock()
+	defer REMINDERS.Unlock()
+
+	for i, r := range REMINDERS.Items {
+		if r.Id != n {
+			continue
+		}
+		if r.User != user && !is_admin(user) {
+			return "That isn't your reminder."
+		}
+		REMINDERS.Items = append(REMINDERS.Items[:i], REMINDERS.Items[i+1:]...)
+		if err := save_reminders(); err != nil {
+			return "I couldn't save your reminders: " + err.Error()
+		}
+		wake_reminders()
+		REMINDER_COUNT.Inc("remind", "cancelled")
+		return fmt.Sprintf("Cancelled reminder #%d.", n)
+	}
+	return fmt.Sprintf("There's no reminder #%d.", n)
+}
+
+func reminders(user, args string) string {
+	words := strings.Fields(args)
+	if len(words) > 0 && strings.ToLower(words[0]) == "cancel" {
+		return cancel_reminder(user, strings.Join(words[1:], " "))
+	}
+	return list_reminders(user)
+}
+
+func is_admin(user string) bool {
+	for _, admin := range profile().Admin {
+		if admin == user {
+			return true
+		}
+	}
+	return false
+}
+
+// due_reminders removes and returns every reminder that should have fired by
+// now, along with the time the next one is due. The reminders are returned
+// even if saving what's left fails.
+func due_reminders(now time.Time) ([]Reminder, time.Time, error) {
+	REMINDERS.Lock()
+	defer REMINDERS.Unlock()
+
+	sort.Slice(REMINDERS.Items, func(i, j int) bool {
+		return REMINDERS.Items[i].When.Before(REMINDERS.Items[j].When)
+	})
+	n := sort.Search(len(REMINDERS.Items), func(i int) bool {
+		return REMINDERS.Items[i].When.After(now)
+	})
+	due := append([]Reminder(nil), REMINDERS.Items[:n]...)
+	REMINDERS.Items = REMINDERS.Items[n:]
+	var err error
+	if n > 0 {
+		err = save_reminders()
+	}
+
+	next := now.Add(time.Hour)
+	if len(REMINDERS.Items) > 0 && REMINDERS.Items[0].When.Before(next) {
+		next = REMINDERS.Items[0].When
+	}
+	return due, next, err
+}
+
+// retry_reminder puts back a reminder that couldn't be delivered, to be tried
+// again after reminder_retry.
+func retry_reminder(r Reminder, now time.Time) error {
+	REMINDERS.Lock()
+	defer REMINDERS.Unlock()
+
+	r.When = now.Add(reminder_retry)
+	REMINDERS.Items = append(REMINDERS.Items, r)
+	return save_reminders()
+}
+
+func reminder_scheduler(ctx context.Context, chSender chan InternalMessage) {
+	log := logger("REMINDER")
+	for {
+		now := time.Now()
+		due, next, err := due_reminders(now)
+		if err != nil {
+			log.Error("Error saving reminders", "error", err)
+		}
+		for _, r := range due {
+			msg := allocInternalMessage()
+			if r.Channel == "" {
+				channel, err := dm_channel(r.User)
+				if err != nil {
+					log.Error("Error opening DM", "user", r.User, "error", err)
+					if err := retry_reminder(r, now); err != nil {
+						log.Error("Error saving reminders", "error", err)
+					}
+					if retry := now.Add(reminder_retry); retry.Before(next) {
+						next = retry
+					}
+					continue
+				}
+				msg.Outgoing.ChannelId = channel
+				msg.Outgoing.Text = "⏰ Reminder: " + r.Text
+			} else {
+				msg.Outgoing.ChannelId = r.Channel
+				msg.Outgoing.Text = fmt.Sprintf("⏰ Reminder from <@%s>: %s", r.User, r.Text)
+			}
+
+			log.Info("Sending reminder", "id", r.Id)
+			REMINDER_COUNT.Inc("remind", "fired")
+			notify(NOTIFY_REMINDER, msg, chSender)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(next.Sub(now)):
+		case <-REMINDER_WAKE:
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseWhenWeekdayRollsForward(t *testing.T) {
+	TIMEZONE = time.UTC
+	now := time.Now().In(TIMEZONE)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, TIMEZONE)
+
+	// Midnight today has always passed, so it means the same day next week.
+	words := strings.Fields(strings.ToLower(now.Weekday().String()) + " 12am standup")
+	when, used, err := parse_when(words, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used != 2 {
+		t.Errorf("used %d words, want 2", used)
+	}
+	if want := today.AddDate(0, 0, 7); !when.Equal(want) {
+		t.Errorf("when = %s, want %s", when, want)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/nlopes/slack"
+	"io"
+	"math/rand"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// RTM holds the websocket currently connected to Slack, if any. It is
+// replaced every time supervise_rtm reconnects.
+var RTM struct {
+	sync.Mutex
+	ws    *slack.SlackWS
+	since time.Time
+}
+
+const (
+	rtm_min_backoff = time.Second
+	rtm_max_backoff = 5 * time.Minute
+	rtm_keepalive   = 20 * time.Second
+)
+
+func current_rtm() *slack.SlackWS {
+	RTM.Lock()
+	defer RTM.Unlock()
+	return RTM.ws
+}
+
+func set_rtm(ws *slack.SlackWS) {
+	RTM.Lock()
+	RTM.ws = ws
+	RTM.since = time.Now()
+	RTM.Unlock()
+}
+
+// backoff doubles the wait for every failed attempt, starting at min and
+// capped at max, and picks a random point in the upper half so retries don't
+// stampede.
+func backoff(attempt int, min, max time.Duration) time.Duration {
+	d := min
+	for i := 1; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// close_rtm closes a connection we're done with, so its reader gets an error
+// and exits instead of reading from Slack forever, and throws away whatever
+// the reader was still trying to deliver until it has. The library has no way
+// to close a connection and keeps the websocket to itself, so it is dug out
+// by reflection.
+func close_rtm(ws *slack.SlackWS, events chan slack.SlackEvent) {
+	go func() {
+		for range events {
+		}
+	}()
+
+	field := reflect.ValueOf(ws).Elem().FieldByName("conn")
+	if !field.IsValid() || field.Kind() != reflect.Ptr || field.IsNil() {
+		return
+	}
+	conn := reflect.NewAt(field.Type(), unsafe.Pointer(field.UnsafeAddr())).Elem().Interface()
+	if closer, ok := conn.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+// rtm_keepalive_loop pings Slack and reports the connection lost as soon as
+// a ping can't be written.
+func rtm_keepalive_loop(ctx context.Context, ws *slack.SlackWS, lost chan string) {
+	ticker := time.NewTicker(rtm_keepalive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := ws.Ping(); err != nil {
+				select {
+				case lost <- "ping failed: " + err.Error():
+				default:
+				}
+				return
+			}
+		}
+	}
+}
+
+// supervise_rtm keeps a websocket to Slack open for as long as ctx lives. It
+// fetches a fresh RTM URL for every connection, passes incoming messages on
+// to incoming, and reconnects with backoff whenever the connection drops or
+// Slack reports an error on it.
+func supervise_rtm(ctx context.Context, s *slackAdapter, incoming chan Message) {
+	log := logger("RTM")
+	attempt := 0
+	for {
+		ws, err := s.api.StartRTM("", "http://localhost/")
+		if err != nil {
+			attempt++
+			wait := backoff(attempt, rtm_min_backoff, rtm_max_backoff)
+			log.Error("Error starting websocket", "attempt", attempt, "retry_in", wait, "error", err)
+			if !sleep(ctx, wait) {
+				return
+			}
+			continue
+		}
+		log.Info("Connected to Slack")
+		connected := time.Now()
+		set_rtm(ws)
+		chat_connected()
+
+		connCtx, cancel := context.WithCancel(ctx)
+		events := make(chan slack.SlackEvent, 10)
+		lost := make(chan string, 1)
+
+		// The reader panics when the connection fails, including when
+		// close_rtm closes it, and closes events once it's gone.
+		go func() {
+			reason := "event loop ended"
+			defer func() {
+				if r := recover(); r != nil {
+					reason = fmt.Sprintf("event loop failed: %v", r)
+				}
+				select {
+				case lost <- reason:
+				default:
+				}
+				close(events)
+			}()
+			ws.HandleIncomingEvents(events)
+		}()
+		go rtm_keepalive_loop(connCtx, ws, lost)
+
+		reason, reading := "", events
+		for reason == "" {
+			select {
+			case <-ctx.Done():
+				cancel()
+				close_rtm(ws, events)
+				return
+			case reason = <-lost:
+			case event, ok := <-reading:
+				if !ok {
+					// lost has the reason.
+					reading = nil
+					continue
+				}
+				if e, ok := event.Data.(*slack.SlackWSError); ok {
+					reason = fmt.Sprintf("slack error %d - %s", e.Code, e.Msg)
+				}
+				handle_slack_event(ctx, s, event, incoming)
+			}
+		}
+		cancel()
+		close_rtm(ws, events)
+		set_rtm(nil)
+
+		if time.Since(connected) > time.Minute {
+			attempt = 0
+		}
+		attempt++
+		wait := backoff(attempt, rtm_min_backoff, rtm_max_backoff)
+		log.Warn("Lost connection", "reason", reason, "retry_in", wait)
+		CHAT_RECONNECTS.Inc()
+		if !sleep(ctx, wait) {
+			return
+		}
+	}
+}
+
+// handle_slack_event passes messages on to incoming and keeps track of the
+// connection's latency.
+func handle_slack_event(ctx context.Context, s *slackAdapter, event slack.SlackEvent, incoming chan Message) {
+	log := logger("RECEIVER")
+	switch e := event.Data.(type) {
+	case slack.HelloEvent:
+		//Ignore Hello, might want a DM to me
+	case *slack.MessageEvent:
+		if (e.SubType != "" && e.SubType != "thread_broadcast") || s.from_self(e.UserId, e.BotId) {
+			return
+		}
+		msg := Message{Id: e.Timestamp, UserId: e.UserId, ChannelId: e.ChannelId, Text: e.Text, Direct: strings.HasPrefix(e.ChannelId, "D")}
+		if !msg.Direct && strings.HasPrefix(msg.Text, "^") {
+			msg.ThreadId = s.thread_of(msg.ChannelId, msg.Id)
+		}
+		select {
+		case incoming <- msg:
+		case <-ctx.Done():
+		}
+	//case *slack.PresenceChangeEvent:
+	//	a := msg.Data.(*slack.PresenceChangeEvent)
+	case slack.LatencyReport:
+		record_latency(e.Value)
+		RTM_LATENCY.Observe(e.Value.Seconds())
+
+		log.Debug("Current latency report", "latency", e.Value)
+	case *slack.SlackWSError:
+		log.Warn("Slack error message", "code", e.Code, "error", e.Msg)
+	default:
+
+		log.Debug("Unexpected / Don't Care", "event", fmt.Sprintf("%+v", event.Data))
+	}
+}
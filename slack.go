@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/nlopes/slack"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// SLACK_API is where Slack Web API methods are called.
+var SLACK_API = "https://slack.com/api/"
+
+// slackAdapter receives over the RTM websocket, or over HTTP from the Events
+// API when listen is set, and sends through the Web API, which, unlike the
+// websocket, tells us the id of what we posted.
+type slackAdapter struct {
+	api            *slack.Slack
+	token          string
+	client         *http.Client
+	listen         string
+	signing_secret string
+
+	sync.Mutex
+	listening bool
+	self      string
+	events    map[string]time.Time
+}
+
+func new_slack_adapter(token, listen, signing_secret string) *slackAdapter {
+	api := slack.New(token)
+	api.SetDebug(false)
+	return &slackAdapter{api: api, token: token, client: &http.Client{Timeout: 15 * time.Second}, listen: listen, signing_secret: signing_secret}
+}
+
+func (s *slackAdapter) Run(ctx context.Context, incoming chan Message) {
+	s.whoami()
+	if s.listen != "" {
+		s.serve_slack_events(ctx, incoming)
+		return
+	}
+	supervise_rtm(ctx, s, incoming)
+}
+
+// whoami looks up the bot's own user id, so it doesn't answer itself.
+func (s *slackAdapter) whoami() {
+	reply, err := s.call("auth.test", url.Values{})
+	if err != nil {
+		logger("SLACK").Warn("Couldn't look up the bot's own user", "error", err)
+		return
+	}
+	s.Lock()
+	s.self, _ = reply["user_id"].(string)
+	s.Unlock()
+}
+
+// from_self reports whether a message was posted by the bot, or by any other
+// bot, neither of which should be taken as a command.
+func (s *slackAdapter) from_self(user, bot string) bool {
+	s.Lock()
+	defer s.Unlock()
+	return bot != "" || user == "" || user == s.self
+}
+
+// thread_of finds the thread a message was posted in, which the RTM library
+// predates and so doesn't tell us. The first of a message's replies is the
+// thread's parent.
+func (s *slackAdapter) thread_of(channel, ts string) string {
+	reply, err := s.call("conversations.replies", url.Values{"channel": {channel}, "ts": {ts}, "limit": {"1"}})
+	if err != nil {
+		logger("SLACK").Debug("Couldn't look up the thread", "channel", channel, "ts", ts, "error", err)
+		return ""
+	}
+	messages, _ := reply["messages"].([]interface{})
+	if len(messages) == 0 {
+		return ""
+	}
+	parent, _ := messages[0].(map[string]interface{})
+	if thread, _ := parent["thread_ts"].(string); thread != ts {
+		return thread
+	}
+	return ""
+}
+
+func (s *slackAdapter) Connected() bool {
+	if s.listen != "" {
+		s.Lock()
+		defer s.Unlock()
+		return s.listening
+	}
+	return current_rtm() != nil
+}
+
+func (s *slackAdapter) set_listening(listening bool) {
+	s.Lock()
+	s.listening = listening
+	s.Unlock()
+}
+
+// call makes a Web API request, turning Slack's {"ok": false} replies into
+// errors.
+func (s *slackAdapter) call(method string, params url.Values) (map[string]interface{}, error) {
+	params.Set("token", s.token)
+	response, err := s.client.PostForm(SLACK_API+method, params)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	var reply map[string]interface{}
+	if err := json.NewDecoder(response.Body).Decode(&reply); err != nil {
+		return nil, fmt.Errorf("%s: %s (HTTP %d)", method, err, response.StatusCode)
+	}
+	if ok, _ := reply["ok"].(bool); !ok {
+		reason, _ := reply["error"].(string)
+		return reply, &chatError{
+			Message:   method + ": " + reason,
+			Temporary: reason == "ratelimited" || reason == "service_unavailable" || reason == "internal_error",
+		}
+	}
+	return reply, nil
+}
+
+// Slack's limits on Block Kit messages.
+const (
+	slack_max_blocks  = 50
+	slack_max_header  = 150
+	slack_max_section = 3000
+)
+
+// slack_truncate cuts text to at most max bytes with an ellipsis, backing up
+// to a rune boundary and, for mrkdwn, to before any <link|label> or <@user>
+// the cut would split.
+func slack_truncate(text string, max int, mrkdwn bool) string {
+	if len(text) <= max {
+		return text
+	}
+	cut := max - 3
+	for cut > 0 && !utf8.RuneStart(text[cut]) {
+		cut--
+	}
+	if mrkdwn {
+		if open := strings.LastIndex(text[:cut], "<"); open >= 0 && !strings.Contains(text[open:cut], ">") {
+			cut = open
+		}
+	}
+	return text[:cut] + "..."
+}
+
+// slack_blocks lays blocks out with Block Kit: a header for each, then its
+// lines in as many sections as Slack's length limit needs. It returns nil if
+// they won't fit in one message, leaving the message to its text.
+func slack_blocks(blocks []Block) []interface{} {
+	text := func(kind, text string) map[string]string {
+		return map[string]string{"type": kind, "text": text}
+	}
+	var layout []interface{}
+	for _, block := range blocks {
+		heading := slack_truncate(block.Heading, slack_max_header, false)
+		layout = append(layout, map[string]interface{}{"type": "header", "text": text("plain_text", heading)})
+
+		section := ""
+		for _, line := range block.Lines {
+			line = slack_truncate(line, slack_max_section, true)
+			if section != "" && len(section)+2+len(line) > slack_max_section {
+				layout = append(layout, map[string]interface{}{"type": "section", "text": text("mrkdwn", section)})
+				section = ""
+			}
+			if section != "" {
+				section += "\n\n"
+			}
+			section += line
+		}
+		if section != "" {
+			layout = append(layout, map[string]interface{}{"type": "section", "text": text("mrkdwn", section)})
+		}
+	}
+	if len(layout) > slack_max_blocks {
+		logger("SLACK").Debug("Too many blocks, sending text", "blocks", len(layout))
+		return nil
+	}
+	return layout
+}
+
+func (s *slackAdapter) Send(msg Message) (string, error) {
+	if msg.ReplyTo != "" {
+		return "", s.respond(msg.ReplyTo, msg)
+	}
+	params := url.Values{
+		"channel": {msg.ChannelId},
+		"text":    {msg.Text},
+		"as_user": {"true"},
+	}
+	if msg.ThreadId != "" {
+		params.Set("thread_ts", msg.ThreadId)
+	}
+	if layout := slack_blocks(msg.Blocks); layout != nil {
+		blocks, err := json.Marshal(layout)
+		if err != nil {
+			return "", err
+		}
+		params.Set("blocks", string(blocks))
+	}
+	reply, err := s.call("chat.postMessage", params)
+	if err != nil {
+		return "", err
+	}
+	ts, _ := reply["ts"].(string)
+	return ts, nil
+}
+
+func (s *slackAdapter) Edit(channel, id, text string) error {
+	_, err := s.call("chat.update", url.Values{
+		"channel": {channel},
+		"ts":      {id},
+		"text":    {text},
+	})
+	return err
+}
+
+func (s *slackAdapter) React(channel, id, emoji string) error {
+	_, err := s.call("reactions.add", url.Values{
+		"channel":   {channel},
+		"timestamp": {id},
+		"name":      {emoji},
+	})
+	return err
+}
+
+func (s *slackAdapter) DM(user string) (string, error) {
+	_, _, channel, err := s.api.OpenIMChannel(user)
+	return channel, err
+}
+
+func slack_chat_user(user slack.User) ChatUser {
+	return ChatUser{Id: user.Id, Name: user.Name, Email: user.Profile.Email, TZ: user.TZ}
+}
+
+func (s *slackAdapter) User(id string) (ChatUser, error) {
+	user, err := s.api.GetUserInfo(id)
+	if err != nil {
+		return ChatUser{}, err
+	}
+	return slack_chat_user(*user), nil
+}
+
+// Users lists everyone in the workspace except bots and deactivated accounts.
+func (s *slackAdapter) Users() ([]ChatUser, error) {
+	users, err := s.api.GetUsers()
+	if err != nil {
+		return nil, err
+	}
+	var chat_users []ChatUser
+	for _, user := range users {
+		if !user.Deleted && !user.IsBot {
+			chat_users = append(chat_users, slack_chat_user(user))
+		}
+	}
+	return chat_users, nil
+}
+
+func (s *slackAdapter) Channel(name string) (string, error) {
+	channels, err := s.api.GetChannels(true)
+	if err != nil {
+		return "", err
+	}
+	for _, channel := range channels {
+		if channel.Name == name {
+			return channel.Id, nil
+		}
+	}
+	return "", fmt.Errorf("I don't know a channel called #%s", name)
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Slack apps that can't use RTM get events and slash commands over HTTP
+// instead. Point the app's Event Subscriptions at /slack/events and its slash
+// command (e.g. /cal) at /slack/commands on Slack-Listen; both are signed with
+// the app's Slack-Signing-Secret.
+const (
+	slack_max_body  = 1 << 20
+	slack_max_skew  = 5 * time.Minute
+	slack_event_ttl = 10 * time.Minute
+	slack_slash_use = "Try `/cal events`, `/cal remind me tomorrow 9am ...` or `/cal reminders`."
+)
+
+// verify_slack_signature checks that body was sent by Slack: the signature
+// is an HMAC of the timestamp and body, and the timestamp must be recent so
+// old requests can't be replayed.
+func verify_slack_signature(secret string, header http.Header, body []byte, now time.Time) error {
+	timestamp := header.Get("X-Slack-Request-Timestamp")
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("missing or bad timestamp %q", timestamp)
+	}
+	if skew := now.Sub(time.Unix(seconds, 0)); skew > slack_max_skew || skew < -slack_max_skew {
+		return fmt.Errorf("timestamp is %s off", skew)
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("v0:" + timestamp + ":"))
+	mac.Write(body)
+	expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(header.Get("X-Slack-Signature"))) {
+		return fmt.Errorf("bad signature")
+	}
+	return nil
+}
+
+// slack_request reads and verifies a request's body, answering it with an
+// error if it can't be trusted.
+func (s *slackAdapter) slack_request(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	log := logger("SLACK_EVENTS")
+	if r.Method != "POST" {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return nil, false
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, slack_max_body))
+	if err != nil {
+		http.Error(w, "can't read body", http.StatusBadRequest)
+		return nil, false
+	}
+	if err := verify_slack_signature(s.signing_secret, r.Header, body, time.Now()); err != nil {
+		log.Warn("Rejected request", "path", r.URL.Path, "remote", r.RemoteAddr, "reason", err)
+		http.Error(w, "bad signature", http.StatusUnauthorized)
+		return nil, false
+	}
+	return body, true
+}
+
+func (s *slackAdapter) events_handler(ctx context.Context, incoming chan Message) http.Handler {
+	log := logger("SLACK_EVENTS")
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/slack/events", func(w http.ResponseWriter, r *http.Request) {
+		body, ok := s.slack_request(w, r)
+		if !ok {
+			return
+		}
+		var callback struct {
+			Type      string `json:"type"`
+			Challenge string `json:"challenge"`
+			EventId   string `json:"event_id"`
+			Event     struct {
+				Type        string `json:"type"`
+				Subtype     string `json:"subtype"`
+				BotId       string `json:"bot_id"`
+				User        string `json:"user"`
+				Channel     string `json:"channel"`
+				ChannelType string `json:"channel_type"`
+				Text        string `json:"text"`
+				Ts          string `json:"ts"`
+				ThreadTs    string `json:"thread_ts"`
+			} `json:"event"`
+		}
+		if err := json.Unmarshal(body, &callback); err != nil {
+			http.Error(w, "bad json", http.StatusBadRequest)
+			return
+		}
+
+		switch callback.Type {
+		case "url_verification":
+			w.Header().Set("Content-Type", "text/plain")
+			fmt.Fprint(w, callback.Challenge)
+			return
+		case "event_callback":
+		default:
+			log.Debug("Unexpected / Don't Care", "type", callback.Type)
+			return
+		}
+
+		// Slack retries an event it thinks we missed, but the first try may
+		// well have got through.
+		if s.seen_event(callback.EventId, time.Now()) {
+			log.Debug("Ignoring repeated event", "event_id", callback.EventId, "retry", r.Header.Get("X-Slack-Retry-Num"), "reason", r.Header.Get("X-Slack-Retry-Reason"))
+			return
+		}
+		event := callback.Event
+		if event.Type != "message" || (event.Subtype != "" && event.Subtype != "thread_broadcast") || s.from_self(event.User, event.BotId) {
+			log.Debug("Unexpected / Don't Care", "event", event.Type, "subtype", event.Subtype)
+			return
+		}
+		select {
+		case incoming <- Message{Id: event.Ts, UserId: event.User, ChannelId: event.Channel, Text: event.Text, ThreadId: event.ThreadTs, Direct: event.ChannelType == "im"}:
+		case <-ctx.Done():
+		}
+	})
+
+	// Slash commands run the same commands as typing them with a ^, and are
+	// answered through their response_url.
+	mux.HandleFunc("/slack/commands", func(w http.ResponseWriter, r *http.Request) {
+		body, ok := s.slack_request(w, r)
+		if !ok {
+			return
+		}
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			http.Error(w, "bad form", http.StatusBadRequest)
+			return
+		}
+		text := strings.TrimPrefix(strings.TrimSpace(form.Get("text")), "^")
+		if text == "" {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"response_type": "ephemeral", "text": slack_slash_use})
+			return
+		}
+		log.Debug("Slash command", "command", form.Get("command"), "user", form.Get("user_id"), "text", text)
+		select {
+		case incoming <- Message{UserId: form.Get("user_id"), ChannelId: form.Get("channel_id"), Text: "^" + text, ReplyTo: form.Get("response_url"), Direct: form.Get("channel_name") == "directmessage"}:
+		case <-ctx.Done():
+		}
+	})
+
+	return mux
+}
+
+// seen_event records an event id and reports whether it had already come in
+// during the last slack_event_ttl, which covers all of Slack's retries.
+func (s *slackAdapter) seen_event(id string, now time.Time) bool {
+	if id == "" {
+		return false
+	}
+	s.Lock()
+	defer s.Unlock()
+	if s.events == nil {
+		s.events = make(map[string]time.Time)
+	}
+	for seen, at := range s.events {
+		if now.Sub(at) > slack_event_ttl {
+			delete(s.events, seen)
+		}
+	}
+	if _, ok := s.events[id]; ok {
+		return true
+	}
+	s.events[id] = now
+	return false
+}
+
+// serve_slack_events receives Slack's HTTP callbacks on s.listen until ctx
+// is cancelled. There's no connection to lose, so the adapter counts as
+// connected for as long as it is listening.
+func (s *slackAdapter) serve_slack_events(ctx context.Context, incoming chan Message) {
+	log := logger("SLACK_EVENTS").With("addr", s.listen)
+	server := &http.Server{Addr: s.listen, Handler: s.events_handler(ctx, incoming)}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	attempt := 0
+	for ctx.Err() == nil {
+		listener, err := net.Listen("tcp", s.listen)
+		if err != nil {
+			attempt++
+			wait := backoff(attempt, rtm_min_backoff, rtm_max_backoff)
+			log.Error("Can't listen for Slack events", "error", err, "retry_in", wait)
+			if !sleep(ctx, wait) {
+				return
+			}
+			continue
+		}
+
+		s.set_listening(true)
+		log.Info("Listening for Slack events and slash commands")
+		chat_connected()
+		err = server.Serve(listener)
+		s.set_listening(false)
+		if err != nil && err != http.ErrServerClosed {
+			log.Error("Slack events server failed", "error", err)
+		}
+		return
+	}
+}
+
+// respond answers a slash command through its response_url, which works even
+// in channels the bot hasn't joined.
+func (s *slackAdapter) respond(response_url string, msg Message) error {
+	reply := map[string]interface{}{"response_type": "in_channel", "text": msg.Text}
+	if layout := slack_blocks(msg.Blocks); layout != nil {
+		reply["blocks"] = layout
+	}
+	body, err := json.Marshal(reply)
+	if err != nil {
+		return err
+	}
+	response, err := s.client.Post(response_url, "application/json", strings.NewReader(string(body)))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		reason, _ := ioutil.ReadAll(response.Body)
+		return &chatError{
+			Message:   fmt.Sprintf("response_url: %d %s", response.StatusCode, strings.TrimSpace(string(reason))),
+			Temporary: response.StatusCode >= 500,
+		}
+	}
+	return nil
+}
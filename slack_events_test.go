@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sign_slack returns the headers Slack would send with body at when.
+func sign_slack(secret string, body []byte, when time.Time) http.Header {
+	timestamp := strconv.FormatInt(when.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("v0:" + timestamp + ":"))
+	mac.Write(body)
+	header := make(http.Header)
+	header.Set("X-Slack-Request-Timestamp", timestamp)
+	header.Set("X-Slack-Signature", "v0="+hex.EncodeToString(mac.Sum(nil)))
+	return header
+}
+
+func TestVerifySlackSignature(t *testing.T) {
+	now := time.Now()
+	body := []byte(`{"type":"event_callback"}`)
+
+	tests := []struct {
+		name   string
+		header http.Header
+		body   []byte
+		ok     bool
+	}{
+		{"valid", sign_slack("secret", body, now), body, true},
+		{"tampered body", sign_slack("secret", body, now), []byte(`{"type":"url_verification"}`), false},
+		{"wrong secret", sign_slack("guess", body, now), body, false},
+		{"stale timestamp", sign_slack("secret", body, now.Add(-slack_max_skew-time.Minute)), body, false},
+		{"missing timestamp", http.Header{"X-Slack-Signature": {"v0=00"}}, body, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := verify_slack_signature("secret", test.header, test.body, now)
+			if (err == nil) != test.ok {
+				t.Errorf("err = %v", err)
+			}
+		})
+	}
+}
+
+func TestSlackEventsDropsReplays(t *testing.T) {
+	s := new_slack_adapter("xoxb-token", ":0", "secret")
+	incoming := make(chan Message, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server := httptest.NewServer(s.events_handler(ctx, incoming))
+	defer server.Close()
+
+	post := func(body, retry string) {
+		request, _ := http.NewRequest("POST", server.URL+"/slack/events", strings.NewReader(body))
+		request.Header = sign_slack("secret", []byte(body), time.Now())
+		if retry != "" {
+			request.Header.Set("X-Slack-Retry-Num", retry)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			t.Errorf("status = %d", response.StatusCode)
+		}
+	}
+	event := func(id, ts string) string {
+		return `{"type":"event_callback","event_id":"` + id + `","event":{"type":"message","user":"U1","channel":"C1","text":"^events","ts":"` + ts + `"}}`
+	}
+
+	post(event("Ev1", "1.1"), "")
+	post(event("Ev1", "1.1"), "1")
+	post(event("Ev2", "1.2"), "")
+
+	for _, want := range []string{"1.1", "1.2"} {
+		select {
+		case msg := <-incoming:
+			if msg.Id != want {
+				t.Errorf("got message %s, want %s", msg.Id, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("never got message %s", want)
+		}
+	}
+	select {
+	case msg := <-incoming:
+		t.Errorf("the replayed event came through again: %+v", msg)
+	default:
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSlackTruncate(t *testing.T) {
+	tests := []struct {
+		name   string
+		text   string
+		max    int
+		mrkdwn bool
+		want   string
+	}{
+		{"short", "Standup", 10, true, "Standup"},
+		{"plain", "Standup at nine", 10, true, "Standup..."},
+		{"rune boundary", "Caféé!", 7, false, "Caf..."},
+		{"inside a link", "See <https://example.com|the doc>", 20, true, "See ..."},
+		{"after a link", "<@U1> has a long day", 15, true, "<@U1> has a ..."},
+		{"plain text keeps <", "a <b and more", 8, false, "a <b ..."},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := slack_truncate(test.text, test.max, test.mrkdwn)
+			if got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+			if len(got) > test.max && got != test.text {
+				t.Errorf("%q is longer than %d", got, test.max)
+			}
+		})
+	}
+}
+
+func TestSlackBlocksTruncatesLongLines(t *testing.T) {
+	line := strings.Repeat("é", slack_max_section) + " <https://example.com|link>"
+	layout := slack_blocks([]Block{{Heading: strings.Repeat("日", slack_max_header), Lines: []string{line}}})
+	for _, block := range layout {
+		text := block.(map[string]interface{})["text"].(map[string]string)["text"]
+		if !utf8.ValidString(text) {
+			t.Errorf("%s block isn't valid UTF-8", block.(map[string]interface{})["type"])
+		}
+	}
+	section := layout[1].(map[string]interface{})["text"].(map[string]string)["text"]
+	if len(section) > slack_max_section || !strings.HasSuffix(section, "...") {
+		t.Errorf("section is %d bytes, ends %q", len(section), section[len(section)-10:])
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// VERSION and COMMIT are set at build time, e.g.
+//
+//	go build -ldflags "-X main.VERSION=1.2.0 -X main.COMMIT=$(git rev-parse --short HEAD)"
+var VERSION = "dev"
+var COMMIT = "unknown"
+
+// STATUS collects what the bot has been up to, for /status and /readyz.
+var STATUS = struct {
+	sync.Mutex
+	started           time.Time
+	calendar_ok       time.Time
+	calendar_error    string
+	calendar_error_at time.Time
+	latency           time.Duration
+	connected         time.Time
+	last_digest       time.Time
+	scheduled         []scheduledNotification
+}{started: time.Now()}
+
+// scheduledNotification is a channel or DM reminder for a calendar event that
+// recurring_notifier has a timer waiting on.
+type scheduledNotification struct {
+	Fire    time.Time
+	Summary string
+	User    string
+}
+
+func record_calendar_call(err error) {
+	STATUS.Lock()
+	defer STATUS.Unlock()
+
+	if err == nil {
+		STATUS.calendar_ok = time.Now()
+		return
+	}
+	STATUS.calendar_error = err.Error()
+	STATUS.calendar_error_at = time.Now()
+}
+
+func record_latency(d time.Duration) {
+	STATUS.Lock()
+	STATUS.latency = d
+	STATUS.Unlock()
+}
+
+func record_digest() {
+	STATUS.Lock()
+	STATUS.last_digest = time.Now()
+	STATUS.Unlock()
+}
+
+func set_scheduled_notifications(scheduled []scheduledNotification) {
+	scheduled = append([]scheduledNotification(nil), scheduled...)
+	sort.Slice(scheduled, func(i, j int) bool { return scheduled[i].Fire.Before(scheduled[j].Fire) })
+
+	STATUS.Lock()
+	STATUS.scheduled = scheduled
+	STATUS.Unlock()
+}
+
+// pending_notifications returns the scheduled notifications that haven't
+// fired yet.
+func pending_notifications() []scheduledNotification {
+	STATUS.Lock()
+	defer STATUS.Unlock()
+
+	now := time.Now()
+	var pending []scheduledNotification
+	for _, n := range STATUS.scheduled {
+		if n.Fire.After(now) {
+			pending = append(pending, n)
+		}
+	}
+	return pending
+}
+
+func pending_reminders() []Reminder {
+	REMINDERS.Lock()
+	defer REMINDERS.Unlock()
+	return append([]Reminder(nil), REMINDERS.Items...)
+}
+
+func format_uptime(d time.Duration) string {
+	d = d.Truncate(time.Minute)
+	days := d / (24 * time.Hour)
+	d -= days * 24 * time.Hour
+	if days > 0 {
+		return fmt.Sprintf("%dd %dh %dm", days, d/time.Hour, (d%time.Hour)/time.Minute)
+	}
+	return fmt.Sprintf("%dh %dm", d/time.Hour, (d%time.Hour)/time.Minute)
+}
+
+func format_status_time(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.In(TIMEZONE).Format("Mon Jan 2 3:04pm")
+}
+
+func uptime_command(user string) string {
+	if !is_admin(user) {
+		return "Only admins can do that."
+	}
+	STATUS.Lock()
+	defer STATUS.Unlock()
+	return fmt.Sprintf("Up %s, since %s.", format_uptime(time.Since(STATUS.started)), format_status_time(STATUS.started))
+}
+
+// status_command reports the bot's health for admins.
+func status_command(user string) string {
+	if !is_admin(user) {
+		return "Only admins can do that."
+	}
+
+	connected := "disconnected"
+	if up, since := chat_status(); up {
+		connected = "connected since " + format_status_time(since)
+	}
+
+	calendars := subscribed_calendars()
+	for _, name := range profile().Announce_Changes {
+		calendars = append(calendars, resolve_calendar(name)+" (announcing changes)")
+	}
+
+	STATUS.Lock()
+	lines := []string{
+		fmt.Sprintf("*Version:* %s (%s)", VERSION, COMMIT),
+		fmt.Sprintf("*Profile:* %s", TEAM),
+		fmt.Sprintf("*Uptime:* %s", format_uptime(time.Since(STATUS.started))),
+		fmt.Sprintf("*Chat:* %s, latency %s", connected, STATUS.latency),
+		fmt.Sprintf("*Calendars:* %s", strings.Join(calendars, ", ")),
+		fmt.Sprintf("*Last morning digest:* %s", format_status_time(STATUS.last_digest)),
+		fmt.Sprintf("*Last Calendar success:* %s", format_status_time(STATUS.calendar_ok)),
+	}
+	if STATUS.calendar_error != "" {
+		lines = append(lines, fmt.Sprintf("*Last Calendar error:* %s at %s", STATUS.calendar_error, format_status_time(STATUS.calendar_error_at)))
+	} else {
+		lines = append(lines, "*Last Calendar error:* none")
+	}
+	STATUS.Unlock()
+
+	notifications := pending_notifications()
+	lines = append(lines, fmt.Sprintf("*Event notifications scheduled today:* %d", len(notifications)))
+	for _, n := range notifications {
+		where := "the channel"
+		if n.User != "" {
+			where = "<@" + n.User + ">"
+		}
+		lines = append(lines, fmt.Sprintf("    %s %s → %s", format_reminder_time(n.Fire), n.Summary, where))
+	}
+	pending := pending_reminders()
+	sort.Slice(pending, func(i, j int) bool { return pending[i].When.Before(pending[j].When) })
+	lines = append(lines, fmt.Sprintf("*Pending reminders:* %d", len(pending)))
+	for _, r := range pending {
+		where := "<@" + r.User + ">"
+		if r.Channel != "" {
+			where = "<#" + r.Channel + ">"
+		}
+		lines = append(lines, fmt.Sprintf("    #%d %s → %s", r.Id, format_reminder_time(r.When), where))
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Subscription asks for event reminders to be sent to a user as a direct
+// message. An empty Calendar matches every configured calendar, and an empty
+// Search matches every event on the calendar.
+type Subscription struct {
+	Name     string          `json:"name"`
+	Calendar string          `json:"calendar,omitempty"`
+	Search   string          `json:"search,omitempty"`
+	Offsets  []time.Duration `json:"offsets"`
+}
+
+var SUBSCRIPTIONS = make(map[string][]Subscription)
+var SUBS_LOCK sync.Mutex
+
+var default_offsets = []time.Duration{time.Hour, 10 * time.Minute}
+
+var offset_rx = regexp.MustCompile("(?i)^(\\d+) ?(m|mins?|minutes?|h|hrs?|hours?|d|days?)$")
+
+func parse_offset(offset string) (time.Duration, bool) {
+	res := offset_rx.FindStringSubmatch(strings.TrimSpace(offset))
+	if res == nil {
+		return 0, false
+	}
+	n, _ := strconv.Atoi(res[1])
+	switch strings.ToLower(res[2])[0] {
+	case 'm':
+		return time.Duration(n) * time.Minute, true
+	case 'h':
+		return time.Duration(n) * time.Hour, true
+	}
+	return time.Duration(n) * 24 * time.Hour, true
+}
+
+func format_offset(d time.Duration) string {
+	switch {
+	case d%(24*time.Hour) == 0:
+		return fmt.Sprintf("%dd", d/(24*time.Hour))
+	case d%time.Hour == 0:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d > time.Hour:
+		return fmt.Sprintf("%dh%dm", d/time.Hour, (d%time.Hour)/time.Minute)
+	}
+	return fmt.Sprintf("%dm", d/time.Minute)
+}
+
+func load_subscriptions() error {
+	data, err := ioutil.ReadFile(SUBFILE)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	SUBS_LOCK.Lock()
+	defer SUBS_LOCK.Unlock()
+	return json.Unmarshal(data, &SUBSCRIPTIONS)
+}
+
+// save_subscriptions must be called with SUBS_LOCK held.
+func save_subscriptions() error {
+	data, err := json.MarshalIndent(SUBSCRIPTIONS, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(SUBFILE+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(SUBFILE+".tmp", SUBFILE)
+}
+
+// split_offsets pulls any trailing reminder offsets ("1h", "30 minutes") off
+// the end of a command's arguments.
+func split_offsets(args string) (string, []time.Duration) {
+	var offsets []time.Duration
+	words := strings.Fields(args)
+	for len(words) > 0 {
+		if d, ok := parse_offset(words[len(words)-1]); ok {
+			offsets = append([]time.Duration{d}, offsets...)
+			words = words[:len(words)-1]
+		} else if len(words) > 1 {
+			if d, ok := parse_offset(strings.Join(words[len(words)-2:], " ")); ok {
+				offsets = append([]time.Duration{d}, offsets...)
+				words = words[:len(words)-2]
+			} else {
+				break
+			}
+		} else {
+			break
+		}
+	}
+	return strings.Join(words, " "), offsets
+}
+
+func describe_subscription(sub Subscription) string {
+	var offsets []string
+	for _, d := range sub.Offsets {
+		offsets = append(offsets, format_offset(d))
+	}
+	kind := "events matching"
+	if sub.Search == "" {
+		kind = "calendar"
+	}
+	return fmt.Sprintf("%s '%s' (%s before)", kind, sub.Name, strings.Join(offsets, ", "))
+}
+
+func list_subscriptions(user string) string {
+	SUBS_LOCK.Lock()
+	defer SUBS_LOCK.Unlock()
+
+	subs := SUBSCRIPTIONS[user]
+	if len(subs) == 0 {
+		return "You aren't subscribed to anything. Try `^subscribe <calendar|event search> [1h 10m]`."
+	}
+	reply := "You're subscribed to:"
+	for _, sub := range subs {
+		reply += "\n• " + describe_subscription(sub)
+	}
+	return reply
+}
+
+func subscribe(user, args string) string {
+	target, offsets := split_offsets(args)
+	if target == "" {
+		return list_subscriptions(user)
+	}
+	if len(offsets) == 0 {
+		offsets = append([]time.Duration(nil), default_offsets...)
+	}
+	sort.Sort(sort.Reverse(durations(offsets)))
+
+	sub := Subscription{Name: target, Offsets: offsets}
+	switch {
+	case strings.ToLower(target) == "all":
+	case strings.ToLower(target) == "default":
+		sub.Calendar = profile().Default_Calendar
+	default:
+		sub.Search = strings.ToLower(target)
+		for i, cal_name := range profile().Calendar_Name {
+			if strings.ToLower(cal_name) == strings.ToLower(target) && i < len(profile().Calendar) {
+				sub.Calendar = profile().Calendar[i]
+				sub.Search = ""
+				break
+			}
+		}
+	}
+
+	SUBS_LOCK.Lock()
+	defer SUBS_LOCK.Unlock()
+
+	subs := SUBSCRIPTIONS[user]
+	for i, existing := range subs {
+		if strings.ToLower(existing.Name) == strings.ToLower(sub.Name) {
+			subs = append(subs[:i], subs[i+1:]...)
+			break
+		}
+	}
+	SUBSCRIPTIONS[user] = append(subs, sub)
+	if err := save_subscriptions(); err != nil {
+		return "I couldn't save that subscription: " + err.Error()
+	}
+	replan_notifications()
+	return "Okay, I'll DM you about " + describe_subscription(sub) + "."
+}
+
+func unsubscribe(user, args string) string {
+	target := strings.ToLower(strings.TrimSpace(args))
+
+	SUBS_LOCK.Lock()
+	defer SUBS_LOCK.Unlock()
+
+	var kept []Subscription
+	for _, sub := range SUBSCRIPTIONS[user] {
+		if target != "" && strings.ToLower(sub.Name) != target {
+			kept = append(kept, sub)
+		}
+	}
+	if len(kept) == len(SUBSCRIPTIONS[user]) {
+		return "You aren't subscribed to that."
+	}
+
+	if len(kept) == 0 {
+		delete(SUBSCRIPTIONS, user)
+	} else {
+		SUBSCRIPTIONS[user] = kept
+	}
+	if err := save_subscriptions(); err != nil {
+		return "I couldn't save your subscriptions: " + err.Error()
+	}
+	replan_notifications()
+	if target == "" {
+		return "Okay, you're unsubscribed from everything."
+	}
+	return "Okay, you're unsubscribed from '" + args + "'."
+}
+
+// subscribers_for returns the reminder offsets wanted by each user for an
+// event on the given calendar.
+func subscribers_for(calendarId, summary string) map[string][]time.Duration {
+	SUBS_LOCK.Lock()
+	defer SUBS_LOCK.Unlock()
+
+	wanted := make(map[string][]time.Duration)
+	for user, subs := range SUBSCRIPTIONS {
+		seen := make(map[time.Duration]bool)
+		for _, sub := range subs {
+			if sub.Calendar != "" && sub.Calendar != calendarId {
+				continue
+			}
+			if sub.Search != "" && !strings.Contains(strings.ToLower(summary), sub.Search) {
+				continue
+			}
+			for _, d := range sub.Offsets {
+				if !seen[d] {
+					seen[d] = true
+					wanted[user] = append(wanted[user], d)
+				}
+			}
+		}
+	}
+	return wanted
+}
+
+// longest_offset is the earliest anyone wants reminding before an event, which
+// is how far past today the notifier has to look for events.
+func longest_offset() time.Duration {
+	longest := time.Hour
+	SUBS_LOCK.Lock()
+	defer SUBS_LOCK.Unlock()
+	for _, subs := range SUBSCRIPTIONS {
+		for _, sub := range subs {
+			for _, d := range sub.Offsets {
+				if d > longest {
+					longest = d
+				}
+			}
+		}
+	}
+	return longest
+}
+
+// subscribed_calendars lists every calendar the notifier needs to look at:
+// the default calendar plus any calendar a subscription could match.
+func subscribed_calendars() []string {
+	calendars := []string{profile().Default_Calendar}
+	seen := map[string]bool{profile().Default_Calendar: true}
+	add := func(id string) {
+		if !seen[id] {
+			seen[id] = true
+			calendars = append(calendars, id)
+		}
+	}
+
+	SUBS_LOCK.Lock()
+	defer SUBS_LOCK.Unlock()
+	for _, subs := range SUBSCRIPTIONS {
+		for _, sub := range subs {
+			if sub.Calendar != "" {
+				add(sub.Calendar)
+				continue
+			}
+			for _, id := range profile().Calendar {
+				add(id)
+			}
+		}
+	}
+	return calendars
+}
+
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }